@@ -13,7 +13,23 @@ func init() {
 	// 注意：环境变量需在 Vercel控制台 设置
 	pkg.LoadConfig()
 	pkg.InitLogger()
+	pkg.InitOutboundProxy()
+	pkg.InitUpstream()
+	pkg.InitLimiter()
+	pkg.InitRetryBudget()
+	pkg.InitBackends()
+	pkg.InitModelCatalog()
+	pkg.InitSigner()
+	pkg.InitConversations()
+	pkg.InitStreamShaping()
+	pkg.InitStreamResume()
+	pkg.InitUsageLedger()
+	pkg.InitBudgets()
+	pkg.InitTokenPool()
 	// 警告：StartVersionUpdater 被跳过，因为 Serverless 环境不支持后台常驻进程
+	// 前端版本在请求中按 FE_VERSION_TTL 懒刷新，并缓存到 FE_VERSION_CACHE（默认 /tmp）
+	// 模型目录在 /v1/models 被访问且已过期时触发刷新
+	// 号池账号在首次使用时于后台登录，登录完成前 pool 请求返回 503
 }
 
 // Handler 是 Vercel 的入口函数
@@ -25,10 +41,35 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		pkg.HandleModels(w, r)
 		return
 	}
+	// 续传路径包含 /v1/chat/completions，需先匹配
+	if strings.Contains(r.URL.Path, pkg.ResumePath) {
+		pkg.HandleStreamResume(w, r)
+		return
+	}
 	if strings.Contains(r.URL.Path, "/v1/chat/completions") {
 		pkg.HandleChatCompletions(w, r)
 		return
 	}
+	if strings.Contains(r.URL.Path, "/admin/usage") {
+		pkg.HandleAdminUsage(w, r)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/admin/signer") {
+		pkg.HandleAdminSigner(w, r)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/admin/fe-version") {
+		pkg.HandleAdminFeVersion(w, r)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/health") {
+		pkg.HandleHealth(w, r)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/metrics") {
+		pkg.HandleMetrics(w, r)
+		return
+	}
 
 	// 默认 404
 	http.NotFound(w, r)
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"zai-proxy/pkg"
+	"zai-proxy/pkg/fakeupstream"
+)
+
+// runCommand 处理子命令并返回退出码，ok 为 false 表示不是子命令，按代理服务启动
+func runCommand(args []string) (code int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "fake-upstream":
+		return runFakeUpstream(args[1:]), true
+	case "replay":
+		return runReplay(args[1:]), true
+	case "signer-test":
+		return runSignerTest(args[1:]), true
+	}
+	return 0, false
+}
+
+// runFakeUpstream 启动模拟 z.ai 服务器，配合 UPSTREAM_BASE_URL 使用
+func runFakeUpstream(args []string) int {
+	fs := flag.NewFlagSet("fake-upstream", flag.ExitOnError)
+	addr := fs.String("addr", ":9090", "listen address")
+	fixtures := fs.String("fixtures", "", "directory of additional *.json scripts")
+	feVersion := fs.String("fe-version", "prod-fe-1.0.0", "frontend version embedded in the home page")
+	fs.Parse(args)
+
+	server := fakeupstream.New()
+	server.FeVersion = *feVersion
+	if *fixtures != "" {
+		if err := server.LoadDir(*fixtures); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load fixtures: %v\n", err)
+			return 1
+		}
+	}
+
+	names := server.ScriptNames()
+	sort.Strings(names)
+	fmt.Printf("Fake z.ai upstream listening on %s\n", *addr)
+	fmt.Printf("Scripts (selected by the latest user message, default %q): %v\n", fakeupstream.DefaultScript, names)
+	if err := http.ListenAndServe(*addr, server.Handler()); err != nil {
+		fmt.Fprintf(os.Stderr, "server failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runReplay 用当前转换逻辑重放录制的上游 SSE，并与当时的输出比较
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	showOutput := fs.Bool("output", false, "print the replayed output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: zai-proxy replay [-output] <recording.json>")
+		return 2
+	}
+
+	pkg.LoadConfig()
+	pkg.InitLogger()
+
+	rec, err := pkg.LoadRecording(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load recording: %v\n", err)
+		return 1
+	}
+
+	replayed := rec.Replay()
+	if *showOutput {
+		fmt.Println(replayed)
+	}
+
+	diff := pkg.DiffServed(rec.Served, replayed)
+	if diff == nil {
+		fmt.Printf("%s: replayed output matches the recorded output (%d upstream lines)\n", rec.CompletionID, len(rec.Upstream))
+		return 0
+	}
+	fmt.Printf("%s: replayed output differs from the recorded output\n", rec.CompletionID)
+	fmt.Println("--- recorded")
+	fmt.Println("+++ replayed")
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+	return 1
+}
+
+// runSignerTest 用已知样例校验签名方案（默认方案或 SIGNER_CONFIG/SIGNER_CONFIG_FILE/-config 指定的方案）
+func runSignerTest(args []string) int {
+	fs := flag.NewFlagSet("signer-test", flag.ExitOnError)
+	configFile := fs.String("config", "", "signer config JSON file (default: SIGNER_CONFIG or SIGNER_CONFIG_FILE)")
+	vectorsFile := fs.String("vectors", "", "JSON file with additional vectors to check")
+	fs.Parse(args)
+
+	pkg.LoadConfig()
+	pkg.InitLogger()
+
+	var params pkg.SignerParams
+	var err error
+	if *configFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(*configFile); err == nil {
+			params, err = pkg.ParseSignerParams(data)
+		}
+	} else {
+		params, err = pkg.LoadSignerParams()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load signer config: %v\n", err)
+		return 1
+	}
+
+	vectors := params.KnownVectors()
+	if *vectorsFile != "" {
+		data, err := os.ReadFile(*vectorsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read vectors: %v\n", err)
+			return 1
+		}
+		var extra []pkg.SignerVector
+		if err := json.Unmarshal(data, &extra); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid vectors file: %v\n", err)
+			return 1
+		}
+		vectors = append(vectors, extra...)
+	}
+
+	signer, err := pkg.NewSigner(params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid signer config: %v\n", err)
+		return 1
+	}
+	if len(vectors) == 0 {
+		fmt.Fprintf(os.Stderr, "signer %s: no known vectors to check\n", signer.Version())
+		return 1
+	}
+
+	failures := signer.Check(vectors)
+	for _, failure := range failures {
+		fmt.Println("FAIL", failure)
+	}
+	fmt.Printf("signer %s: %d/%d vectors passed\n", signer.Version(), len(vectors)-len(failures), len(vectors))
+	if len(failures) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -2,17 +2,45 @@ package main
 
 import (
 	"net/http"
+	"os"
 
 	"zai-proxy/pkg"
 )
 
 func main() {
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	pkg.LoadConfig()
 	pkg.InitLogger()
+	pkg.InitOutboundProxy()
+	pkg.InitUpstream()
+	pkg.InitLimiter()
+	pkg.InitRetryBudget()
+	pkg.InitBackends()
+	pkg.InitModelCatalog()
+	pkg.InitSigner()
+	pkg.InitConversations()
+	pkg.InitStreamShaping()
+	pkg.InitStreamResume()
+	pkg.InitUsageLedger()
+	pkg.InitBudgets()
+	pkg.InitTokenPool()
 	pkg.StartVersionUpdater()
+	pkg.StartTokenRefresher()
+	pkg.StartModelCatalogUpdater()
+	pkg.StartSignerWatcher()
 
 	http.HandleFunc("/v1/models", pkg.HandleModels)
 	http.HandleFunc("/v1/chat/completions", pkg.HandleChatCompletions)
+	http.HandleFunc(pkg.ResumePath, pkg.HandleStreamResume)
+	http.HandleFunc(pkg.WebSocketPath, pkg.HandleWebSocket)
+	http.HandleFunc("/admin/usage", pkg.HandleAdminUsage)
+	http.HandleFunc("/admin/signer", pkg.HandleAdminSigner)
+	http.HandleFunc("/admin/fe-version", pkg.HandleAdminFeVersion)
+	http.HandleFunc("/health", pkg.HandleHealth)
+	http.HandleFunc("/metrics", pkg.HandleMetrics)
 
 	addr := ":" + pkg.Cfg.Port
 	pkg.LogInfo("Server starting on %s", addr)
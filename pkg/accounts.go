@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoPooledToken = errors.New("no usable token in pool")
+
+// ErrPoolSigningIn 池中的账号尚未取得 token，登录正在后台进行
+var ErrPoolSigningIn = errors.New("no token yet, pool accounts are signing in")
+
+type SignInResponse struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+// SignIn 使用邮箱密码登录 z.ai 获取 token
+func SignIn(email, password string) (string, error) {
+	return upstream.SignIn(context.Background(), email, password)
+}
+
+// poolAccount 池中的一个上游凭据：邮箱密码账号（可自动续期）或静态 token
+type poolAccount struct {
+	name     string
+	email    string
+	password string
+
+	mu          sync.Mutex
+	token       string
+	obtainedAt  time.Time
+	expiresAt   time.Time
+	lastErr     error
+	lastAttempt time.Time
+	signingIn   bool // 后台登录进行中
+}
+
+// 登录失败后的最短重试间隔，避免每个请求都触发登录
+const signInRetryInterval = 30 * time.Second
+
+func (a *poolAccount) canSignIn() bool {
+	return a.email != ""
+}
+
+func (a *poolAccount) setToken(token string) {
+	a.token = token
+	a.obtainedAt = time.Now()
+	a.expiresAt = time.Time{}
+	if payload, err := DecodeJWTPayload(token); err == nil && payload != nil {
+		if payload.Exp > 0 {
+			a.expiresAt = time.Unix(payload.Exp, 0)
+		}
+		if a.email != "" {
+			aliasTokenProxy(payload.ID, a.email)
+		}
+	}
+}
+
+// needsRefresh 判断 token 是否缺失或即将在 margin 内过期
+// 有效期较短的 token 最多提前其有效期的一半续期，避免反复登录
+func (a *poolAccount) needsRefresh(margin time.Duration) bool {
+	if a.token == "" {
+		return true
+	}
+	if a.expiresAt.IsZero() {
+		return false
+	}
+	if half := a.expiresAt.Sub(a.obtainedAt) / 2; half < margin {
+		margin = half
+	}
+	return time.Until(a.expiresAt) < margin
+}
+
+// startRefresh 在后台重新登录，已在登录或距上次失败不足 signInRetryInterval 时不重复发起，调用方需持有 a.mu
+// 登录请求不持有 a.mu，完成后再替换 token，期间其他请求照常使用旧 token
+func (a *poolAccount) startRefresh() {
+	if a.signingIn || (a.lastErr != nil && time.Since(a.lastAttempt) < signInRetryInterval) {
+		return
+	}
+	a.signingIn = true
+	a.lastAttempt = time.Now()
+	go a.signIn()
+}
+
+func (a *poolAccount) signIn() {
+	token, err := SignIn(a.email, a.password)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.signingIn = false
+	if err != nil {
+		a.lastErr = err
+		LogError("[TokenPool] Sign-in failed for %s: %v", a.name, err)
+		return
+	}
+	a.setToken(token)
+	a.lastErr = nil
+	LogInfo("[TokenPool] Signed in %s, token expires at %s", a.name, a.expiresAt.Format(time.RFC3339))
+}
+
+// currentToken 返回可用 token；需要续期时在后台登录，尚无 token 时返回 ErrPoolSigningIn 或上次登录的错误
+func (a *poolAccount) currentToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.canSignIn() && a.needsRefresh(Cfg.TokenRefreshMargin) {
+		a.startRefresh()
+	}
+	if a.token == "" {
+		if a.signingIn {
+			return "", ErrPoolSigningIn
+		}
+		if a.lastErr != nil {
+			return "", a.lastErr
+		}
+		return "", ErrNoPooledToken
+	}
+	if !a.expiresAt.IsZero() && time.Now().After(a.expiresAt) {
+		if a.signingIn {
+			return "", ErrPoolSigningIn
+		}
+		return "", fmt.Errorf("token for %s expired", a.name)
+	}
+	return a.token, nil
+}
+
+// TokenPool 按轮询方式提供上游 token，客户端使用 "Bearer pool" 时从池中选取
+type TokenPool struct {
+	accounts []*poolAccount
+	next     uint32
+}
+
+var tokenPool = &TokenPool{}
+
+// InitTokenPool 根据 ZAI_ACCOUNTS、ZAI_ACCOUNTS_FILE 与 ZAI_TOKENS 构建 token 池，账号在首次使用或 StartTokenRefresher 时于后台登录
+func InitTokenPool() {
+	pool := &TokenPool{}
+	entries := splitList(Cfg.Accounts)
+	if Cfg.AccountsFile != "" {
+		data, err := os.ReadFile(Cfg.AccountsFile)
+		if err != nil {
+			LogError("Failed to read ZAI_ACCOUNTS_FILE: %v", err)
+		}
+		// 每行一个账号，密码可以包含逗号与冒号；空行与 # 开头的行被忽略
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+	for _, item := range entries {
+		// 邮箱中没有冒号，按第一个冒号分隔，密码可以包含冒号
+		email, password, ok := strings.Cut(item, ":")
+		if !ok {
+			LogWarn("Invalid ZAI_ACCOUNTS entry, expected email:password")
+			continue
+		}
+		pool.accounts = append(pool.accounts, &poolAccount{
+			name:     email,
+			email:    email,
+			password: password,
+		})
+	}
+	for i, token := range splitList(Cfg.StaticTokens) {
+		acct := &poolAccount{name: fmt.Sprintf("static-%d", i+1)}
+		acct.setToken(token)
+		pool.accounts = append(pool.accounts, acct)
+	}
+	tokenPool = pool
+	if len(pool.accounts) > 0 {
+		LogInfo("Token pool initialized with %d entries", len(pool.accounts))
+	}
+}
+
+// Size 返回池中凭据数量
+func (p *TokenPool) Size() int {
+	return len(p.accounts)
+}
+
+// Get 轮询获取一个可用 token，exclude 中的 token 会被跳过；没有可用 token 且有账号正在登录时返回 ErrPoolSigningIn
+func (p *TokenPool) Get(exclude ...string) (string, error) {
+	n := len(p.accounts)
+	if n == 0 {
+		return "", ErrNoPooledToken
+	}
+
+	start := atomic.AddUint32(&p.next, 1)
+	signingIn := false
+	for i := 0; i < n; i++ {
+		acct := p.accounts[(int(start)+i)%n]
+		token, err := acct.currentToken()
+		if err == ErrPoolSigningIn {
+			signingIn = true
+		}
+		if err != nil || containsString(exclude, token) {
+			continue
+		}
+		return token, nil
+	}
+	if signingIn {
+		return "", ErrPoolSigningIn
+	}
+	return "", ErrNoPooledToken
+}
+
+// StartTokenRefresher 在后台登录账号并提前续期即将过期的 token，不阻塞启动
+func StartTokenRefresher() {
+	var signInAccounts []*poolAccount
+	for _, acct := range tokenPool.accounts {
+		if acct.canSignIn() {
+			signInAccounts = append(signInAccounts, acct)
+		}
+	}
+	if len(signInAccounts) == 0 {
+		return
+	}
+
+	refreshDue := func() {
+		for _, acct := range signInAccounts {
+			acct.mu.Lock()
+			if acct.needsRefresh(Cfg.TokenRefreshMargin) {
+				acct.startRefresh()
+			}
+			acct.mu.Unlock()
+		}
+	}
+	refreshDue()
+
+	ticker := time.NewTicker(1 * time.Minute)
+	go func() {
+		for range ticker.C {
+			refreshDue()
+		}
+	}()
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
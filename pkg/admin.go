@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin 校验管理接口的 ADMIN_TOKEN，未配置时管理接口不可用
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if Cfg.AdminToken == "" {
+		http.Error(w, "Admin API disabled", http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(Cfg.AdminToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleAdminUsage 返回按 日期/key/模型 聚合的用量，format=csv 时导出 CSV
+func HandleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if usageLedger == nil {
+		http.Error(w, "Usage ledger disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	summaries, err := usageLedger.Aggregate(UsageFilter{
+		From:  q.Get("from"),
+		To:    q.Get("to"),
+		Key:   q.Get("key"),
+		Model: q.Get("model"),
+	})
+	if err != nil {
+		LogError("Failed to aggregate usage: %v", err)
+		http.Error(w, "Failed to read usage ledger", http.StatusInternalServerError)
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"day", "key", "model", "requests", "errors", "aborted", "prompt_tokens", "completion_tokens", "reasoning_tokens", "images", "total_latency_ms"})
+		for _, s := range summaries {
+			cw.Write([]string{
+				s.Day, s.Key, s.Model,
+				strconv.Itoa(s.Requests),
+				strconv.Itoa(s.Errors),
+				strconv.Itoa(s.Aborted),
+				strconv.Itoa(s.PromptTokens),
+				strconv.Itoa(s.CompletionTokens),
+				strconv.Itoa(s.ReasoningTokens),
+				strconv.Itoa(s.Images),
+				strconv.FormatInt(s.TotalLatencyMs, 10),
+			})
+		}
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   summaries,
+	})
+}
+
+// HandleAdminSigner GET 返回当前签名方案，POST 提交新的签名参数（JSON），通过自带样例校验后立即生效
+func HandleAdminSigner(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		params, err := ParseSignerParams(data)
+		if err != nil {
+			http.Error(w, "Invalid signer config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := SetSigner(params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := CurrentSigner().Params()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":     params.Version,
+		"key_sha256":  hashIdentifier(params.Key),
+		"layout":      params.Layout,
+		"data_layout": params.DataLayout,
+		"period_ms":   params.PeriodMs,
+		"vectors":     len(params.KnownVectors()),
+	})
+}
+
+// HandleAdminFeVersion GET 返回当前前端版本及来源，POST 立即从上游刷新
+func HandleAdminFeVersion(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := RefreshFeVersion(); err != nil {
+			http.Error(w, "Failed to refresh fe version: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetFeVersionStatus())
+}
@@ -0,0 +1,421 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 路由目标：z.ai 或 openai-compatible:<后端名>
+const (
+	RouteZAI          = "zai"
+	routeOpenAIPrefix = "openai-compatible:"
+)
+
+// OpenAIBackend 一个 OpenAI 兼容的后端（llama.cpp、vLLM、公司网关等）
+type OpenAIBackend struct {
+	Name    string            `json:"-"`
+	BaseURL string            `json:"base_url"` // 例如 http://127.0.0.1:8080/v1
+	APIKey  string            `json:"api_key,omitempty"`
+	Models  map[string]string `json:"models,omitempty"`  // 对外模型名 -> 后端模型名，未列出时原样使用
+	Timeout string            `json:"timeout,omitempty"` // 为空时使用 UPSTREAM_TIMEOUT
+	Proxy   string            `json:"proxy,omitempty"`   // 为空时使用 OUTBOUND_PROXY
+
+	client *http.Client
+}
+
+var (
+	openAIBackends = map[string]*OpenAIBackend{}
+	modelRoutes    = map[string][]string{}
+)
+
+// InitBackends 解析 OPENAI_BACKENDS 与 MODEL_ROUTES
+func InitBackends() {
+	backends := map[string]*OpenAIBackend{}
+	if Cfg.OpenAIBackends != "" {
+		if err := json.Unmarshal([]byte(Cfg.OpenAIBackends), &backends); err != nil {
+			LogError("Invalid OPENAI_BACKENDS: %v", err)
+			backends = map[string]*OpenAIBackend{}
+		}
+	}
+	for name, b := range backends {
+		if b == nil || b.BaseURL == "" {
+			LogWarn("Backend %q has no base_url, ignored", name)
+			delete(backends, name)
+			continue
+		}
+		b.Name = name
+		b.BaseURL = strings.TrimRight(b.BaseURL, "/")
+		timeout := Cfg.UpstreamTimeout
+		if b.Timeout != "" {
+			if d, err := time.ParseDuration(b.Timeout); err == nil {
+				timeout = d
+			} else {
+				LogWarn("Backend %q has invalid timeout %q: %v", name, b.Timeout, err)
+			}
+		}
+		b.client = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy: proxyFor(b.Proxy),
+				DialContext: (&net.Dialer{
+					Timeout:   Cfg.UpstreamConnectTimeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout: Cfg.UpstreamConnectTimeout,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+
+	routes := parseModelRoutes(Cfg.ModelRoutes)
+	for model, targets := range routes {
+		var valid []string
+		for _, target := range targets {
+			if target == RouteZAI {
+				valid = append(valid, target)
+			} else if name, ok := strings.CutPrefix(target, routeOpenAIPrefix); ok && backends[name] != nil {
+				valid = append(valid, target)
+			} else {
+				LogWarn("MODEL_ROUTES: unknown target %q for %s, ignored", target, model)
+			}
+		}
+		if len(valid) == 0 {
+			delete(routes, model)
+			continue
+		}
+		routes[model] = valid
+	}
+
+	openAIBackends = backends
+	modelRoutes = routes
+	if len(backends) > 0 || len(routes) > 0 {
+		LogInfo("OpenAI-compatible backends: %d, model routes: %v", len(backends), routes)
+	}
+}
+
+// parseModelRoutes 解析 "GLM-4.6=zai,openai-compatible:local;qwen=openai-compatible:local;*=zai" 格式的路由表
+func parseModelRoutes(s string) map[string][]string {
+	routes := make(map[string][]string)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			LogWarn("Invalid MODEL_ROUTES entry %q, expected model=target[,target]", item)
+			continue
+		}
+		routes[strings.TrimSpace(parts[0])] = splitList(parts[1])
+	}
+	return routes
+}
+
+// routeTargets 返回模型的路由目标，按顺序尝试：完整模型名、基础模型名、"*"，默认只走 z.ai
+func routeTargets(model string) []string {
+	if targets, ok := modelRoutes[model]; ok {
+		return targets
+	}
+	baseModel, _, _ := ParseModelName(model)
+	if targets, ok := modelRoutes[baseModel]; ok {
+		return targets
+	}
+	if targets, ok := modelRoutes["*"]; ok {
+		return targets
+	}
+	return []string{RouteZAI}
+}
+
+// routedModels 返回路由表中的对外模型名及其第一个后端，用于 /v1/models（已在目录中的模型不会重复列出）
+func routedModels() []ModelInfo {
+	var models []ModelInfo
+	for model, targets := range modelRoutes {
+		if model == "*" {
+			continue
+		}
+		ownedBy := "z.ai"
+		if name, ok := strings.CutPrefix(targets[0], routeOpenAIPrefix); ok {
+			ownedBy = name
+		}
+		models = append(models, ModelInfo{ID: model, Object: "model", OwnedBy: ownedBy, Source: "route"})
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models
+}
+
+// modelFor 对外模型名对应的后端模型名
+func (b *OpenAIBackend) modelFor(model string) string {
+	if target, ok := b.Models[model]; ok {
+		return target
+	}
+	return model
+}
+
+// breakerModel 对外模型名在 models 映射中对应的后端模型名，未映射的模型共用 breakerOtherModel
+func (b *OpenAIBackend) breakerModel(model string) string {
+	if target, ok := b.Models[model]; ok {
+		return target
+	}
+	return breakerOtherModel
+}
+
+// ChatCompletions 将客户端原始请求转发给后端，替换模型名并始终使用流式输出
+func (b *OpenAIBackend) ChatCompletions(ctx context.Context, rawBody []byte, model string) (*http.Response, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal(rawBody, &body); err != nil {
+		return nil, err
+	}
+	body["model"] = model
+	body["stream"] = true
+	delete(body, "stream_options")
+	data, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.BaseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if b.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.APIKey)
+	}
+	return b.client.Do(req)
+}
+
+// openBackend 请求后端并记录熔断器结果，失败时返回应返回给客户端的状态码
+// 后端返回 429 以外的 4xx 时 resp 原样返回、err 为 nil，由调用方直接转给客户端，不回退到下一个目标
+func openBackend(r *http.Request, b *OpenAIBackend, rawBody []byte, publicModel string) (*http.Response, string, int, error) {
+	model := b.modelFor(publicModel)
+	breaker := upstreamBreakers.Get(b.BaseURL, b.breakerModel(publicModel))
+	if err := breaker.Allow(); err != nil {
+		return nil, model, http.StatusServiceUnavailable, err
+	}
+
+	start := time.Now()
+	resp, err := b.ChatCompletions(r.Context(), rawBody, model)
+	latency := time.Since(start)
+	if err != nil {
+		if r.Context().Err() != nil {
+			breaker.Record(outcomeIgnore, latency)
+		} else {
+			breaker.Record(outcomeFailure, latency)
+		}
+		return nil, model, http.StatusBadGateway, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		breaker.Record(outcomeSuccess, latency)
+		return resp, model, resp.StatusCode, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		resp.Body.Close()
+		// 限流不代表后端故障，不计入熔断
+		if resp.StatusCode == http.StatusTooManyRequests {
+			breaker.Record(outcomeSuccess, latency)
+		} else {
+			breaker.Record(outcomeFailure, latency)
+		}
+		return nil, model, resp.StatusCode, &backendError{status: resp.StatusCode, body: parseErrorBody(body, http.StatusText(resp.StatusCode))}
+	}
+	breaker.Record(outcomeSuccess, latency)
+	return resp, model, http.StatusOK, nil
+}
+
+// backendError 后端返回的 429 或 5xx
+type backendError struct {
+	status int
+	body   *UpstreamError
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("status %d: %v", e.status, e.body)
+}
+
+// backendChunk 后端流式输出中我们关心的字段，工具调用等其它字段会被丢弃
+type backendChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			Reasoning        string `json:"reasoning"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+// readBackendStream 逐个解析后端 SSE 分块，返回最后的 finish_reason
+// 后端输出错误帧或连接在 [DONE] 之前中断时返回 upErr（回答不完整），与 z.ai 路径的错误事件一致
+// 客户端断开（ctx 取消或 onDelta 返回错误）时立即停止并关闭响应体，返回 errClientGone
+func readBackendStream(ctx context.Context, body io.ReadCloser, onDelta func(Delta) error) (finishReason string, upErr *UpstreamError, err error) {
+	stop := context.AfterFunc(ctx, func() { body.Close() })
+	defer stop()
+
+	finishReason = "stop"
+	reader := newSSEReader(body)
+	defer reader.Release()
+	var readErr error
+	for ctx.Err() == nil {
+		line, err := reader.ReadLine()
+		if err != nil {
+			readErr = err
+			break
+		}
+		if currentLevel <= DEBUG {
+			LogDebug("[Backend] %s", line)
+		}
+		payload, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue
+		}
+		payload = bytes.TrimSpace(payload)
+		if bytes.Equal(payload, sseDone) {
+			break
+		}
+		if upErr = parseUpstreamError(payload); upErr != nil {
+			LogError("[Backend] error event: %v", upErr)
+			return FinishReasonError, upErr, nil
+		}
+		var chunk backendChunk
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			reasoning := choice.Delta.ReasoningContent
+			if reasoning == "" {
+				reasoning = choice.Delta.Reasoning
+			}
+			if choice.Delta.Content != "" || reasoning != "" {
+				if err := onDelta(Delta{Content: choice.Delta.Content, ReasoningContent: reasoning}); err != nil {
+					body.Close()
+					return finishReason, nil, errClientGone
+				}
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				finishReason = *choice.FinishReason
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return finishReason, nil, errClientGone
+	}
+	if readErr != nil && readErr != io.EOF {
+		LogError("[Backend] read error: %v", readErr)
+		return FinishReasonError, &UpstreamError{Code: "upstream_read_error", Message: "upstream connection lost: " + readErr.Error()}, nil
+	}
+	return finishReason, nil, nil
+}
+
+// forwardBackendError 将后端的 4xx 响应按 OpenAI 格式返回给客户端，保留后端的 message、type 与 code
+func forwardBackendError(w http.ResponseWriter, resp *http.Response, usage *UsageRecord) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	LogWarn("[Backend] client error: status=%d, body=%s", resp.StatusCode, string(body[:min(500, len(body))]))
+	usage.Fail(resp.StatusCode, "upstream_error")
+	writeErrorResponse(w, resp.StatusCode, parseErrorBody(body, http.StatusText(resp.StatusCode)))
+}
+
+// handleBackendStream 将后端流式输出转换为与 z.ai 路径一致的分块（相同的 id 与模型名）
+func handleBackendStream(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, usage *UsageRecord, resume *resumableStream) {
+	sse := newSSEWriter(w, completionID, modelName)
+	sse.resume = resume
+	defer sse.Close()
+	shaper := newStreamShaper(shapingFor(ctx, usage), func(delta Delta) error {
+		if err := sse.Chunk(delta, nil); err != nil {
+			return err
+		}
+		usage.AddOutput(delta.Content, delta.ReasoningContent)
+		return nil
+	})
+	defer shaper.Close()
+
+	finishReason, upErr, err := readBackendStream(ctx, body, shaper.Write)
+	if err == nil {
+		err = shaper.Flush()
+	}
+	if err == nil && upErr != nil {
+		// 与 z.ai 路径一致：错误事件之后是 finish_reason 为 error 的结束分块
+		usage.Fail(http.StatusBadGateway, "upstream_error")
+		err = sse.Error(upErr)
+	}
+	if err == nil && sse.Chunk(Delta{}, &finishReason) == nil && sse.Done() == nil {
+		return
+	}
+	clientAborted(completionID, usage)
+}
+
+// handleBackendNonStream 汇总后端输出后一次性返回，isStreamRequest 时（响应不支持 Flush）以单个分块模拟流式输出，汇总期间没有心跳
+func handleBackendNonStream(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, isStreamRequest bool, usage *UsageRecord) {
+	var sse *sseWriter
+	if isStreamRequest {
+		sse = newSSEWriter(w, completionID, modelName)
+		defer sse.Close()
+	}
+
+	var content, reasoning strings.Builder
+	finishReason, upErr, err := readBackendStream(ctx, body, func(delta Delta) error {
+		content.WriteString(delta.Content)
+		reasoning.WriteString(delta.ReasoningContent)
+		return nil
+	})
+	if err != nil {
+		clientAborted(completionID, usage)
+		return
+	}
+	usage.AddOutput(content.String(), reasoning.String())
+	if upErr != nil {
+		usage.Fail(http.StatusBadGateway, "upstream_error")
+	}
+
+	if isStreamRequest {
+		var err error
+		if upErr != nil {
+			// 与流式输出一致：已有内容、错误事件、finish_reason 为 error 的结束分块
+			if content.Len() > 0 || reasoning.Len() > 0 {
+				err = sse.Chunk(Delta{Content: content.String(), ReasoningContent: reasoning.String()}, nil)
+			}
+			if err == nil {
+				err = sse.Error(upErr)
+			}
+			if err == nil {
+				err = sse.Chunk(Delta{}, &finishReason)
+			}
+		} else {
+			err = sse.Chunk(Delta{Content: content.String(), ReasoningContent: reasoning.String()}, &finishReason)
+		}
+		if err != nil || sse.Done() != nil {
+			clientAborted(completionID, usage)
+		}
+		return
+	}
+	if upErr != nil {
+		// 回答不完整，按错误响应返回后端的 code 与 message
+		writeErrorResponse(w, http.StatusBadGateway, upErr)
+		return
+	}
+
+	response := ChatCompletionResponse{
+		ID:      completionID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   modelName,
+		Choices: []Choice{{
+			Index: 0,
+			Message: &MessageResp{
+				Role:             "assistant",
+				Content:          content.String(),
+				ReasoningContent: reasoning.String(),
+			},
+			FinishReason: &finishReason,
+		}},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,303 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState 熔断器状态
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerOutcome 一次上游请求对熔断器的影响
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	outcomeIgnore // 客户端取消、token 被拒绝等与上游健康无关的结果
+)
+
+// CircuitOpenError 熔断器打开时快速失败返回的错误
+type CircuitOpenError struct {
+	Target     string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("upstream circuit open for %s, retry after %ds", e.Target, int(e.RetryAfter.Seconds()+0.999))
+}
+
+const breakerBuckets = 10
+
+// breakerBucket 滑动窗口中的一个时间片
+type breakerBucket struct {
+	index    int64
+	total    int
+	failures int
+	slow     int
+}
+
+// CircuitBreaker 单个上游目标（host + 基础模型）的熔断器
+// 窗口内请求数达到下限且错误率或慢请求比例超过阈值时打开，打开一段时间后进入半开状态放行少量探测请求
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	host      string
+	model     string
+	state     BreakerState
+	openedAt  time.Time
+	buckets   [breakerBuckets]breakerBucket
+	probes    int
+	successes int
+	opens     int64
+}
+
+// BreakerStatus 熔断器状态快照，用于健康检查与指标
+type BreakerStatus struct {
+	Host      string  `json:"host"`
+	Model     string  `json:"model"`
+	State     string  `json:"state"`
+	Requests  int     `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	SlowRate  float64 `json:"slow_rate"`
+	Opens     int64   `json:"opens"`
+	OpenedAt  string  `json:"opened_at,omitempty"`
+
+	state BreakerState
+}
+
+func (b *CircuitBreaker) target() string {
+	return b.host + "/" + b.model
+}
+
+func bucketWidth() time.Duration {
+	width := Cfg.BreakerWindow / breakerBuckets
+	if width <= 0 {
+		width = time.Second
+	}
+	return width
+}
+
+// window 汇总仍在窗口内的时间片
+func (b *CircuitBreaker) window(now time.Time) (total, failures, slow int) {
+	current := now.UnixNano() / int64(bucketWidth())
+	for _, bucket := range b.buckets {
+		if current-bucket.index < breakerBuckets {
+			total += bucket.total
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	return
+}
+
+func (b *CircuitBreaker) add(now time.Time, failed, slow bool) {
+	index := now.UnixNano() / int64(bucketWidth())
+	bucket := &b.buckets[index%breakerBuckets]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.opens++
+	LogWarn("[Breaker] %s opened", b.target())
+}
+
+// Allow 判断是否放行一个请求，打开状态下返回 *CircuitOpenError
+func (b *CircuitBreaker) Allow() error {
+	if !Cfg.BreakerEnabled {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == BreakerOpen {
+		if elapsed := now.Sub(b.openedAt); elapsed < Cfg.BreakerOpenDuration {
+			return &CircuitOpenError{Target: b.target(), RetryAfter: Cfg.BreakerOpenDuration - elapsed}
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+		LogInfo("[Breaker] %s half-open, probing", b.target())
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= Cfg.BreakerHalfOpenRequests {
+			return &CircuitOpenError{Target: b.target(), RetryAfter: time.Second}
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Record 记录一次放行请求的结果，latency 为收到上游响应头的耗时
+func (b *CircuitBreaker) Record(outcome breakerOutcome, latency time.Duration) {
+	if !Cfg.BreakerEnabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	slow := Cfg.BreakerSlowThreshold > 0 && latency >= Cfg.BreakerSlowThreshold
+	failed := outcome == outcomeFailure
+
+	if b.state == BreakerHalfOpen {
+		switch {
+		case outcome == outcomeIgnore:
+			if b.probes > 0 {
+				b.probes--
+			}
+		case failed || slow:
+			b.open(now)
+		default:
+			b.successes++
+			if b.successes >= Cfg.BreakerHalfOpenRequests {
+				b.state = BreakerClosed
+				b.buckets = [breakerBuckets]breakerBucket{}
+				LogInfo("[Breaker] %s closed", b.target())
+			}
+		}
+		return
+	}
+	if outcome == outcomeIgnore {
+		return
+	}
+
+	b.add(now, failed, slow)
+	if b.state != BreakerClosed {
+		return
+	}
+	total, failures, slowCount := b.window(now)
+	if total < Cfg.BreakerMinRequests {
+		return
+	}
+	errorRate := float64(failures) / float64(total)
+	slowRate := float64(slowCount) / float64(total)
+	if (Cfg.BreakerErrorRate > 0 && errorRate >= Cfg.BreakerErrorRate) ||
+		(Cfg.BreakerSlowRate > 0 && slowRate >= Cfg.BreakerSlowRate) {
+		b.open(now)
+	}
+}
+
+// Status 返回当前状态快照
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	state := b.state
+	if state == BreakerOpen && now.Sub(b.openedAt) >= Cfg.BreakerOpenDuration {
+		state = BreakerHalfOpen
+	}
+	total, failures, slow := b.window(now)
+	status := BreakerStatus{
+		Host:     b.host,
+		Model:    b.model,
+		State:    state.String(),
+		Requests: total,
+		Opens:    b.opens,
+		state:    state,
+	}
+	if total > 0 {
+		status.ErrorRate = float64(failures) / float64(total)
+		status.SlowRate = float64(slow) / float64(total)
+	}
+	if !b.openedAt.IsZero() {
+		status.OpenedAt = b.openedAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// breakerOtherModel 不在模型目录或后端模型映射中的模型共用的熔断器，避免客户端传入的任意模型名创建新的熔断器与指标标签
+const breakerOtherModel = "other"
+
+// BreakerRegistry 按 host + 上游模型 id 管理熔断器
+type BreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func NewBreakerRegistry() *BreakerRegistry {
+	return &BreakerRegistry{breakers: make(map[string]*CircuitBreaker)}
+}
+
+var upstreamBreakers = NewBreakerRegistry()
+
+// Get 返回 baseURL 所在 host 与模型对应的熔断器，不存在时创建
+// model 须为解析后的上游模型 id 或 breakerOtherModel，见 zaiBreakerModel 与 OpenAIBackend.breakerModel
+func (r *BreakerRegistry) Get(baseURL, model string) *CircuitBreaker {
+	host := baseURL
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := host + "/" + model
+	b, ok := r.breakers[key]
+	if !ok {
+		b = &CircuitBreaker{host: host, model: model}
+		r.breakers[key] = b
+	}
+	return b
+}
+
+// Snapshot 返回所有熔断器的状态，按 host 与模型排序
+func (r *BreakerRegistry) Snapshot() []BreakerStatus {
+	r.mu.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	r.mu.Unlock()
+
+	statuses := make([]BreakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		statuses = append(statuses, b.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Host != statuses[j].Host {
+			return statuses[i].Host < statuses[j].Host
+		}
+		return statuses[i].Model < statuses[j].Model
+	})
+	return statuses
+}
+
+// zaiBreakerModel 请求模型在模型目录中对应的上游模型 id，-thinking/-search 等变体共用同一熔断器
+func zaiBreakerModel(model string) string {
+	baseModel, _, _ := ParseModelName(model)
+	if target, ok := modelCatalog.Target(baseModel); ok {
+		return target
+	}
+	return breakerOtherModel
+}
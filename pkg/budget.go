@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BudgetLimit 单项预算，soft 超出时记录警告，hard 超出时拒绝请求，0 表示不限制
+type BudgetLimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+// BudgetPeriod 一个统计周期内的预算
+type BudgetPeriod struct {
+	Requests BudgetLimit `json:"requests"`
+	Tokens   BudgetLimit `json:"tokens"`
+	Images   BudgetLimit `json:"images"`
+}
+
+// KeyBudget 单个 key 的日/月预算
+type KeyBudget struct {
+	Daily   BudgetPeriod `json:"daily"`
+	Monthly BudgetPeriod `json:"monthly"`
+}
+
+// budgetUsage 一个周期内已消耗的量
+type budgetUsage struct {
+	period   string
+	requests int64
+	tokens   int64
+	images   int64
+}
+
+func (u *budgetUsage) rollover(period string) {
+	if u.period != period {
+		*u = budgetUsage{period: period}
+	}
+}
+
+func (u *budgetUsage) add(tokens int64, images int) {
+	u.requests++
+	u.tokens += tokens
+	u.images += int64(images)
+}
+
+type keyBudgetState struct {
+	daily   budgetUsage
+	monthly budgetUsage
+}
+
+// BudgetTracker 按 key 统计日/月用量并执行预算限制
+// 周期按配置时区的自然日/自然月划分，跨周期时自动清零
+type BudgetTracker struct {
+	mu       sync.Mutex
+	budgets  map[string]KeyBudget
+	location *time.Location
+	states   map[string]*keyBudgetState
+}
+
+var budgetTracker *BudgetTracker
+
+// InitBudgets 解析 KEY_BUDGETS 配置，并从用量账本恢复当前周期的已用量
+func InitBudgets() {
+	if Cfg.KeyBudgets == "" {
+		return
+	}
+
+	var budgets map[string]KeyBudget
+	if err := json.Unmarshal([]byte(Cfg.KeyBudgets), &budgets); err != nil {
+		LogError("Invalid KEY_BUDGETS: %v", err)
+		return
+	}
+
+	loc, err := time.LoadLocation(Cfg.BudgetTimezone)
+	if err != nil {
+		LogError("Invalid BUDGET_TIMEZONE %q, using UTC: %v", Cfg.BudgetTimezone, err)
+		loc = time.UTC
+	}
+
+	tracker := &BudgetTracker{
+		budgets:  budgets,
+		location: loc,
+		states:   make(map[string]*keyBudgetState),
+	}
+	if usageLedger != nil {
+		if err := usageLedger.Scan(tracker.Record); err != nil {
+			LogError("Failed to restore budget usage from ledger: %v", err)
+		}
+	}
+	budgetTracker = tracker
+	LogInfo("Key budgets enabled for %d entries (timezone %s)", len(budgets), loc)
+}
+
+func (t *BudgetTracker) periods(now time.Time) (day, month string) {
+	local := now.In(t.location)
+	return local.Format("2006-01-02"), local.Format("2006-01")
+}
+
+// budgetFor 返回 key 的预算，未单独配置时使用 "default"
+func (t *BudgetTracker) budgetFor(key string) (KeyBudget, bool) {
+	if b, ok := t.budgets[key]; ok {
+		return b, true
+	}
+	b, ok := t.budgets["default"]
+	return b, ok
+}
+
+func (t *BudgetTracker) state(key string, now time.Time) *keyBudgetState {
+	s, ok := t.states[key]
+	if !ok {
+		s = &keyBudgetState{}
+		t.states[key] = s
+	}
+	day, month := t.periods(now)
+	s.daily.rollover(day)
+	s.monthly.rollover(month)
+	return s
+}
+
+// budgetReservation Check 通过时预先计入的请求数与图片数，请求结束时在 Record 中结算
+type budgetReservation struct {
+	day    string
+	month  string
+	images int
+}
+
+// Record 将一次已完成请求计入预算，被拒绝的请求不计入
+// 已在 Check 中预留的请求只补记 token；被拒绝时释放预留
+func (t *BudgetTracker) Record(rec *UsageRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.state(rec.Key, time.Now())
+	if r := rec.budget; r != nil {
+		rec.budget = nil
+		tokens := int64(rec.PromptTokens + rec.CompletionTokens + rec.ReasoningTokens)
+		if rec.Status == "rejected" {
+			tokens = 0
+		}
+		for _, p := range []struct {
+			used   *budgetUsage
+			period string
+		}{{&s.daily, r.day}, {&s.monthly, r.month}} {
+			// 跨周期后预留已随旧周期清零
+			if p.used.period != p.period {
+				continue
+			}
+			if rec.Status == "rejected" {
+				p.used.requests--
+				p.used.images -= int64(r.images)
+			}
+			p.used.tokens += tokens
+		}
+		return
+	}
+	if rec.Status == "rejected" {
+		return
+	}
+
+	day, month := t.periods(rec.Time)
+	tokens := int64(rec.PromptTokens + rec.CompletionTokens + rec.ReasoningTokens)
+	// 账本中早于当前周期的记录不计入
+	if s.daily.period == day {
+		s.daily.add(tokens, rec.Images)
+	}
+	if s.monthly.period == month {
+		s.monthly.add(tokens, rec.Images)
+	}
+}
+
+// BudgetExceededError 硬限制被触发时返回
+type BudgetExceededError struct {
+	Period string
+	Item   string
+	Limit  int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s %s budget of %d exhausted for this key", e.Period, e.Item, e.Limit)
+}
+
+// Check 在请求开始前检查预算，返回剩余额度描述（用于响应头）
+// 超过硬限制时返回 *BudgetExceededError，超过软限制时仅记录警告
+// 通过时在同一把锁内预留本次请求数与图片数，避免同一 key 的并发请求同时通过硬限制
+func (t *BudgetTracker) Check(rec *UsageRecord) (string, error) {
+	key, images := rec.Key, rec.Images
+	budget, ok := t.budgetFor(key)
+	if !ok {
+		return "", nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(key, time.Now())
+
+	remaining := map[string]int64{}
+	checks := []struct {
+		period string
+		limits BudgetPeriod
+		used   *budgetUsage
+	}{
+		{"daily", budget.Daily, &s.daily},
+		{"monthly", budget.Monthly, &s.monthly},
+	}
+	for _, c := range checks {
+		items := []struct {
+			name     string
+			limit    BudgetLimit
+			used     int64
+			incoming int64
+		}{
+			{"requests", c.limits.Requests, c.used.requests, 1},
+			{"tokens", c.limits.Tokens, c.used.tokens, 0},
+			{"images", c.limits.Images, c.used.images, int64(images)},
+		}
+		for _, item := range items {
+			after := item.used + item.incoming
+			if item.limit.Hard > 0 {
+				if after > item.limit.Hard || (item.incoming == 0 && item.used >= item.limit.Hard) {
+					LogWarn("[Budget] key=%s exceeded %s %s hard limit (%d/%d)", key, c.period, item.name, item.used, item.limit.Hard)
+					return "", &BudgetExceededError{Period: c.period, Item: item.name, Limit: item.limit.Hard}
+				}
+				left := item.limit.Hard - after
+				if cur, ok := remaining[item.name]; !ok || left < cur {
+					remaining[item.name] = left
+				}
+			}
+			if item.limit.Soft > 0 && after > item.limit.Soft {
+				LogWarn("[Budget] key=%s over %s %s soft limit (%d/%d)", key, c.period, item.name, after, item.limit.Soft)
+			}
+		}
+	}
+
+	s.daily.add(0, images)
+	s.monthly.add(0, images)
+	rec.budget = &budgetReservation{day: s.daily.period, month: s.monthly.period, images: images}
+
+	var parts []string
+	for _, name := range []string{"requests", "tokens", "images"} {
+		if left, ok := remaining[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, left))
+		}
+	}
+	return strings.Join(parts, "; "), nil
+}
@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 模型目录条目的来源
+const (
+	ModelSourceStatic   = "static"   // 代码中的 BaseModelMapping
+	ModelSourceUpstream = "upstream" // 从上游 /api/models 发现
+	ModelSourceOverride = "override" // MODEL_OVERRIDES 配置
+)
+
+// CatalogEntry 对外基础模型名到上游模型 id 的映射
+type CatalogEntry struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+	Source string `json:"source"`
+}
+
+// ModelCatalog 合并静态映射、上游目录与配置覆盖后的模型目录
+// 刷新失败时保留上一次成功获取的目录
+type ModelCatalog struct {
+	mu         sync.RWMutex
+	entries    map[string]CatalogEntry
+	listed     []string // /v1/models 中的模型名（含 -thinking 等变体），按顺序
+	discovered []UpstreamModelInfo
+	updatedAt  time.Time
+	lastErr    string
+
+	lastAttempt atomic.Int64 // unix 纳秒
+
+	flightMu sync.Mutex
+	flight   *catalogFlight
+}
+
+type catalogFlight struct {
+	done chan struct{}
+	err  error
+}
+
+// CatalogStatus 目录状态，用于健康检查
+type CatalogStatus struct {
+	Models     int    `json:"models"`
+	Discovered int    `json:"discovered"`
+	UpdatedAt  string `json:"updated_at,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+var modelCatalog = newModelCatalog()
+
+func newModelCatalog() *ModelCatalog {
+	c := &ModelCatalog{}
+	c.rebuild()
+	return c
+}
+
+// upstreamPublicName 将上游模型名转换为对外模型名，例如 "GLM 4.6" -> "GLM-4.6"
+func upstreamPublicName(m UpstreamModelInfo) string {
+	name := strings.TrimSpace(m.Name)
+	if name == "" {
+		name = m.ID
+	}
+	return strings.Join(strings.Fields(name), "-")
+}
+
+// rebuild 按 静态映射 < 上游目录 < MODEL_OVERRIDES 的优先级重建目录，调用方需持有写锁或处于初始化阶段
+func (c *ModelCatalog) rebuild() {
+	entries := make(map[string]CatalogEntry)
+	knownTargets := make(map[string]bool)
+	for id, target := range BaseModelMapping {
+		entries[id] = CatalogEntry{ID: id, Target: target, Source: ModelSourceStatic}
+		knownTargets[target] = true
+	}
+
+	listed := append([]string(nil), ModelList...)
+	seen := make(map[string]bool)
+	for _, id := range listed {
+		seen[id] = true
+	}
+	var added []string
+
+	for _, m := range c.discovered {
+		if m.ID == "" || knownTargets[m.ID] {
+			continue
+		}
+		if m.Info.IsActive != nil && !*m.Info.IsActive {
+			continue
+		}
+		id := upstreamPublicName(m)
+		entries[id] = CatalogEntry{ID: id, Target: m.ID, Source: ModelSourceUpstream}
+		if !seen[id] {
+			seen[id] = true
+			added = append(added, id)
+		}
+	}
+
+	if Cfg != nil {
+		for _, item := range splitList(Cfg.ModelOverrides) {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 {
+				LogWarn("Invalid MODEL_OVERRIDES entry %q, expected name=upstream_id", item)
+				continue
+			}
+			id, target := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			entries[id] = CatalogEntry{ID: id, Target: target, Source: ModelSourceOverride}
+			if !seen[id] {
+				seen[id] = true
+				added = append(added, id)
+			}
+		}
+	}
+
+	sort.Strings(added)
+	c.entries = entries
+	c.listed = append(listed, added...)
+}
+
+// Target 返回基础模型名对应的上游模型 id
+func (c *ModelCatalog) Target(baseModel string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[baseModel]
+	return entry.Target, ok
+}
+
+// Models 返回 /v1/models 中列出的模型及其来源
+func (c *ModelCatalog) Models() []ModelInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	models := make([]ModelInfo, 0, len(c.listed))
+	for _, id := range c.listed {
+		baseModel, _, _ := ParseModelName(id)
+		source := c.entries[baseModel].Source
+		if source == "" {
+			source = ModelSourceStatic
+		}
+		models = append(models, ModelInfo{ID: id, Object: "model", OwnedBy: "z.ai", Source: source})
+	}
+	return models
+}
+
+// Status 返回目录状态
+func (c *ModelCatalog) Status() CatalogStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status := CatalogStatus{
+		Models:     len(c.listed),
+		Discovered: len(c.discovered),
+		LastError:  c.lastErr,
+	}
+	if !c.updatedAt.IsZero() {
+		status.UpdatedAt = c.updatedAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// Refresh 从上游获取模型目录，失败时保留上一次的结果；并发调用共享同一次请求并等待其完成
+func (c *ModelCatalog) Refresh() error {
+	c.flightMu.Lock()
+	if f := c.flight; f != nil {
+		c.flightMu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &catalogFlight{done: make(chan struct{})}
+	c.flight = f
+	c.flightMu.Unlock()
+
+	f.err = c.fetch()
+
+	c.flightMu.Lock()
+	c.flight = nil
+	c.flightMu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (c *ModelCatalog) fetch() error {
+	c.lastAttempt.Store(time.Now().UnixNano())
+
+	token, err := tokenPool.Get()
+	if err != nil {
+		token, err = GetAnonymousToken()
+	}
+	var models []UpstreamModelInfo
+	if err == nil {
+		models, err = upstream.ListModels(context.Background(), token)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.lastErr = err.Error()
+		LogWarn("[Models] Failed to refresh upstream catalog, keeping last known: %v", err)
+		return err
+	}
+	c.discovered = models
+	c.updatedAt = time.Now()
+	c.lastErr = ""
+	c.rebuild()
+	LogInfo("[Models] Upstream catalog refreshed: %d upstream models, %d listed", len(models), len(c.listed))
+	return nil
+}
+
+// refreshIfStale 目录超过刷新间隔时在请求内刷新并等待完成，用于没有常驻后台任务的 Serverless 环境
+// （响应返回后后台 goroutine 不保证继续运行）；常驻模式下由 StartModelCatalogUpdater 定期刷新，很少需要等待
+func (c *ModelCatalog) refreshIfStale() {
+	if Cfg.ModelRefreshInterval <= 0 {
+		return
+	}
+	if time.Since(time.Unix(0, c.lastAttempt.Load())) > Cfg.ModelRefreshInterval {
+		c.Refresh()
+	}
+}
+
+// InitModelCatalog 应用 MODEL_OVERRIDES
+func InitModelCatalog() {
+	modelCatalog.mu.Lock()
+	modelCatalog.rebuild()
+	modelCatalog.mu.Unlock()
+}
+
+// StartModelCatalogUpdater 启动时获取一次上游目录，之后按 MODEL_REFRESH_INTERVAL 定期刷新
+func StartModelCatalogUpdater() {
+	if Cfg.ModelRefreshInterval <= 0 {
+		return
+	}
+	go func() {
+		modelCatalog.Refresh()
+		ticker := time.NewTicker(Cfg.ModelRefreshInterval)
+		for range ticker.C {
+			modelCatalog.Refresh()
+		}
+	}()
+}
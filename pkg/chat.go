@@ -1,17 +1,15 @@
 package pkg
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/corpix/uarand"
 	"github.com/google/uuid"
 )
 
@@ -34,7 +32,8 @@ func extractAllImageURLs(messages []Message) []string {
 	return allImageURLs
 }
 
-func makeUpstreamRequest(token string, messages []Message, model string, r *http.Request) (*http.Response, string, error) {
+// buildUpstreamRequest 构造上游对话请求，图片通过 uploads 上传，重试时不重复上传
+func buildUpstreamRequest(ctx context.Context, token string, messages []Message, model string, turn *conversationTurn, uploads *imageUploads) (*UpstreamChatRequest, string, error) {
 	payload, err := DecodeJWTPayload(token)
 	if err != nil || payload == nil {
 		return nil, "", fmt.Errorf("invalid token")
@@ -45,6 +44,18 @@ func makeUpstreamRequest(token string, messages []Message, model string, r *http
 	timestamp := time.Now().UnixMilli()
 	requestID := uuid.New().String()
 	userMsgID := uuid.New().String()
+	assistantMsgID := uuid.New().String()
+
+	// 会话模式下续接上游对话，只发送本轮的新消息
+	var parentID interface{}
+	if prev := turn.continuation(userID); prev != nil {
+		chatID, parentID = prev.ChatID, prev.ParentID
+		messages = messages[turn.turnStart:]
+	}
+	if turn != nil {
+		turn.Continued = parentID != nil
+		turn.ChatID, turn.UserID, turn.MessageID = chatID, userID, assistantMsgID
+	}
 
 	targetModel := GetTargetModel(model)
 	latestUserContent := extractLatestUserContent(messages)
@@ -52,12 +63,6 @@ func makeUpstreamRequest(token string, messages []Message, model string, r *http
 
 	signature := GenerateSignature(userID, requestID, latestUserContent, timestamp)
 
-	url := fmt.Sprintf("https://chat.z.ai/api/v2/chat/completions?timestamp=%d&requestId=%s&user_id=%s&version=0.0.1&platform=web&token=%s&current_url=%s&pathname=%s&signature_timestamp=%d",
-		timestamp, requestID, userID, token,
-		fmt.Sprintf("https://chat.z.ai/c/%s", chatID),
-		fmt.Sprintf("/c/%s", chatID),
-		timestamp)
-
 	enableThinking := IsThinkingModel(model)
 	autoWebSearch := IsSearchModel(model)
 	if targetModel == "glm-4.5v" || targetModel == "glm-4.6v" {
@@ -72,11 +77,17 @@ func makeUpstreamRequest(token string, messages []Message, model string, r *http
 	urlToFileID := make(map[string]string)
 	var filesData []map[string]interface{}
 	if len(imageURLs) > 0 {
-		files, _ := UploadImages(token, imageURLs)
-		for i, f := range files {
-			if i < len(imageURLs) {
-				urlToFileID[imageURLs[i]] = f.ID
+		var files []*UpstreamFile
+		for _, url := range imageURLs {
+			f, err := uploads.upload(ctx, token, userID, url)
+			if err != nil {
+				LogError("Failed to upload image %s: %v", url[:min(50, len(url))], err)
+				continue
 			}
+			urlToFileID[url] = f.ID
+			files = append(files, f)
+		}
+		for _, f := range files {
 			filesData = append(filesData, map[string]interface{}{
 				"type":            f.Type,
 				"file":            f.File,
@@ -112,7 +123,7 @@ func makeUpstreamRequest(token string, messages []Message, model string, r *http
 			"enable_thinking":  enableThinking,
 		},
 		"chat_id": chatID,
-		"id":      uuid.New().String(),
+		"id":      assistantMsgID,
 	}
 
 	if len(mcpServers) > 0 {
@@ -123,55 +134,25 @@ func makeUpstreamRequest(token string, messages []Message, model string, r *http
 		body["files"] = filesData
 		body["current_user_message_id"] = userMsgID
 	}
-
-	bodyBytes, _ := json.Marshal(body)
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
-	if err != nil {
-		return nil, "", err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("X-FE-Version", GetFeVersion())
-	req.Header.Set("X-Signature", signature)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Origin", "https://chat.z.ai")
-	req.Header.Set("Referer", fmt.Sprintf("https://chat.z.ai/c/%s", uuid.New().String()))
-	req.Header.Set("User-Agent", uarand.GetRandom())
-
-	// Pass original request context for timeout/cancellation
-	req = req.WithContext(r.Context())
-
-	// Use global client to reuse connections
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, "", err
+	if turn != nil {
+		body["current_user_message_id"] = userMsgID
+		body["current_user_message_parent_id"] = parentID
 	}
 
-	return resp, targetModel, nil
-}
-
-// Global HTTP client for connection pooling
-var httpClient = &http.Client{
-	Timeout: 300 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
-	},
-}
+	bodyBytes, _ := json.Marshal(body)
 
-// Buffer pool to reduce GC pressure on heavy buffering
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		// Pre-allocate 64KB buffer
-		return bytes.NewBuffer(make([]byte, 0, 64*1024))
-	},
+	return &UpstreamChatRequest{
+		Token:     token,
+		UserID:    userID,
+		RequestID: requestID,
+		ChatID:    chatID,
+		Timestamp: timestamp,
+		Signature: signature,
+		FeVersion: GetFeVersion(),
+		Body:      bodyBytes,
+	}, targetModel, nil
 }
 
-
-
 type UpstreamData struct {
 	Type string `json:"type"`
 	Data struct {
@@ -281,25 +262,47 @@ func (f *ThinkingFilter) ResetForNewRound() {
 	f.hasSeenFirstThinking = false
 }
 
-func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	if token == "free" {
+// resolveUpstreamToken 将客户端的 free/pool 特殊 token 换成真实的上游 token
+// 失败时返回非 0 的状态码与返回给客户端的错误信息
+func resolveUpstreamToken(clientToken string) (token, tokenClass string, status int, message string) {
+	switch clientToken {
+	case "free":
 		anonymousToken, err := GetAnonymousToken()
 		if err != nil {
 			LogError("Failed to get anonymous token: %v", err)
-			http.Error(w, "Failed to get anonymous token", http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError, "Failed to get anonymous token"
+		}
+		return anonymousToken, TokenClassAnonymous, 0, ""
+	case "pool":
+		pooledToken, err := tokenPool.Get()
+		if err == ErrPoolSigningIn {
+			LogWarn("Pooled token requested before sign-in finished")
+			return "", "", http.StatusServiceUnavailable, "No pooled token yet, sign-in in progress"
+		}
+		if err != nil {
+			LogError("Failed to get pooled token: %v", err)
+			return "", "", http.StatusServiceUnavailable, "No pooled token available"
 		}
-		token = anonymousToken
+		return pooledToken, TokenClassPool, 0, ""
 	}
+	return clientToken, TokenClassUser, 0, ""
+}
 
+func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	clientToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if clientToken == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	clientKey := ClientKeyID(clientToken)
+
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
 	var req ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(rawBody, &req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
@@ -308,567 +311,303 @@ func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		req.Model = "GLM-4.6"
 	}
 
-	resp, modelName, err := makeUpstreamRequest(token, req.Messages, req.Model, r)
-	if err != nil {
-		LogError("Upstream request failed: %v", err)
-		http.Error(w, "Upstream error", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
+	usage := NewUsageRecord(clientKey, &req)
+	defer usage.Commit()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		bodyStr := string(body)
-		if len(bodyStr) > 500 {
-			bodyStr = bodyStr[:500]
+	if budgetTracker != nil {
+		remaining, err := budgetTracker.Check(usage)
+		if remaining != "" {
+			w.Header().Set("X-Budget-Remaining", remaining)
+		}
+		if err != nil {
+			usage.Fail(http.StatusTooManyRequests, "rejected")
+			http.Error(w, "Budget exceeded: "+err.Error(), http.StatusTooManyRequests)
+			return
 		}
-		LogError("Upstream error: status=%d, body=%s", resp.StatusCode, bodyStr)
-		http.Error(w, "Upstream error", resp.StatusCode)
-		return
 	}
 
-	completionID := fmt.Sprintf("chatcmpl-%s", uuid.New().String()[:29])
-
-	// Vercel compatibility: Check explicitly if streaming is supported
-	// If Flusher is NOT supported, force non-streaming fallback
-	if req.Stream {
-		if _, ok := w.(http.Flusher); ok {
-			handleStreamResponse(w, resp.Body, completionID, modelName)
+	priority := requestPriority(r.Header.Get("X-Priority"), usage.Key)
+	release, queueWait, err := upstreamLimiter.Acquire(r.Context(), req.Model, priority)
+	w.Header().Set("X-Queue-Wait-Ms", strconv.FormatInt(queueWait.Milliseconds(), 10))
+	if err != nil {
+		LogWarn("Request rejected by concurrency limiter: model=%s, waited=%s, err=%v", req.Model, queueWait, err)
+		if err == ErrQueueFull {
+			usage.Fail(http.StatusTooManyRequests, "rejected")
+			http.Error(w, "Too many queued requests", http.StatusTooManyRequests)
 		} else {
-			// Fallback to non-streaming logic even if client requested stream
-			// This works because makeUpstreamRequest ALWAYS sets stream=true, 
-			// and handleNonStreamResponse correctly consumes the SSE stream.
-			handleNonStreamResponse(w, resp.Body, completionID, modelName, true)
+			usage.Fail(http.StatusServiceUnavailable, "rejected")
+			http.Error(w, "Timed out waiting for upstream capacity", http.StatusServiceUnavailable)
 		}
-	} else {
-		handleNonStreamResponse(w, resp.Body, completionID, modelName, false)
-	}
-}
-
-func handleStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		// This should have been caught in HandleChatCompletions, but double check
-		handleNonStreamResponse(w, body, completionID, modelName, true)
 		return
 	}
+	defer release()
 
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	hasContent := false
-	searchRefFilter := NewSearchRefFilter()
-	thinkingFilter := &ThinkingFilter{}
-	pendingSourcesMarkdown := ""
-	pendingImageSearchMarkdown := ""
-	totalContentOutputLength := 0 // 记录已输出的 content 字符长度
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		LogDebug("[Upstream] %s", line)
-
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
-
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
-
-		if upstream.Data.Phase == "done" {
-			break
-		}
-
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			isNewThinkingRound := false
-			if thinkingFilter.lastPhase != "" && thinkingFilter.lastPhase != "thinking" {
-				thinkingFilter.ResetForNewRound()
-				thinkingFilter.thinkingRoundCount++
-				isNewThinkingRound = true
-			}
-			thinkingFilter.lastPhase = "thinking"
-
-			reasoningContent := thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-
-			if isNewThinkingRound && thinkingFilter.thinkingRoundCount > 1 && reasoningContent != "" {
-				reasoningContent = "\n\n" + reasoningContent
-			}
-
-			if reasoningContent != "" {
-				thinkingFilter.lastOutputChunk = reasoningContent
-				reasoningContent = searchRefFilter.Process(reasoningContent)
-
-				if reasoningContent != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{ReasoningContent: reasoningContent},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
-			}
-			continue
-		}
-
-		if upstream.Data.Phase != "" {
-			thinkingFilter.lastPhase = upstream.Data.Phase
-		}
-
-		editContent := upstream.GetEditContent()
-		if editContent != "" && IsSearchResultContent(editContent) {
-			if results := ParseSearchResults(editContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
+	completionID := fmt.Sprintf("chatcmpl-%s", uuid.New().String()[:29])
+	flushable := canFlush(w)
+	r = withToolActivity(r)
+
+	// 可续传时上游请求与读取不随首个客户端连接断开而停止，客户端重连续传接口补收
+	// WebSocket 请求由 cancel 消息取消，不启用续传
+	resumable := req.Stream && flushable && streamResumes != nil && r.Context().Value(wsRequestKey{}) == nil
+	// 续传缓存在确定以 200 流式输出时才创建：路由失败的请求没有可续接的事件，
+	// 提前创建的条目不会结束，既不会被清理，续接的客户端也会一直等待
+	startResume := func() *resumableStream {
+		if !resumable {
+			return nil
+		}
+		w.Header().Set("X-Resume-URL", ResumePath+"?id="+completionID)
+		return streamResumes.Start(completionID, usage.Key)
+	}
+	if resumable {
+		clientCtx := r.Context()
+		r = r.WithContext(context.WithoutCancel(clientCtx))
+		// 首个连接在输出完成前断开时仍按 client_aborted 记录（先于 usage.Commit 执行）
+		defer func() {
+			if clientCtx.Err() != nil && usage.Status == "" {
+				clientAborted(completionID, usage)
 			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"search_image"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				textBeforeBlock = searchRefFilter.Process(textBeforeBlock)
-				if textBeforeBlock != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{Content: textBeforeBlock},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
+		}()
+	}
+
+	// 按路由表依次尝试各目标，前一个目标在写出任何内容之前失败时回退到下一个
+	// 最终失败时按 OpenAI 格式返回最后一个目标的错误，z.ai 与后端的错误格式一致
+	targets := routeTargets(req.Model)
+	failStatus, failErr := http.StatusBadGateway, &UpstreamError{Message: "Upstream error"}
+	var openErr *CircuitOpenError
+	for i, target := range targets {
+		if i > 0 {
+			LogWarn("[Route] model=%s falling back to %s (previous status %d)", req.Model, target, failStatus)
+		}
+		w.Header().Set("X-Backend", target)
+
+		if target != RouteZAI {
+			backend := openAIBackends[strings.TrimPrefix(target, routeOpenAIPrefix)]
+			resp, modelName, status, err := openBackend(r, backend, rawBody, req.Model)
+			if err != nil {
+				LogError("[Route] backend %s failed: %v", target, err)
+				failStatus, failErr, openErr = status, &UpstreamError{Message: "Upstream error"}, nil
+				switch e := err.(type) {
+				case *CircuitOpenError:
+					failErr, openErr = circuitOpenError(e), e
+				case *backendError:
+					failErr = e.body
 				}
+				continue
 			}
-			if results := ParseImageSearchResults(editContent); len(results) > 0 {
-				pendingImageSearchMarkdown = FormatImageSearchResults(results)
+			defer resp.Body.Close()
+			usage.UpstreamModel = target + "/" + modelName
+			usage.TokenClass = ""
+			// 清除此前 z.ai 尝试留下的响应头，它们描述的不是实际提供服务的目标
+			w.Header().Del("X-Token-Class")
+			w.Header().Del("X-Upstream-Retries")
+			w.Header().Del("X-Session")
+			// 429 以外的 4xx 是请求本身的问题，换目标也不会成功
+			if resp.StatusCode != http.StatusOK {
+				forwardBackendError(w, resp, usage)
+				return
 			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"mcp"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				textBeforeBlock = searchRefFilter.Process(textBeforeBlock)
-				if textBeforeBlock != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{Content: textBeforeBlock},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
+			if req.Stream && flushable {
+				handleBackendStream(r.Context(), w, resp.Body, completionID, modelName, usage, startResume())
+			} else {
+				handleBackendNonStream(r.Context(), w, resp.Body, completionID, modelName, req.Stream, usage)
 			}
-			continue
-		}
-		if editContent != "" && IsSearchToolCall(editContent, upstream.Data.Phase) {
-			continue
+			return
 		}
 
-		if pendingSourcesMarkdown != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{Content: pendingSourcesMarkdown},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingSourcesMarkdown = ""
+		token, tokenClass, status, message := resolveUpstreamToken(clientToken)
+		if status != 0 {
+			failStatus, failErr, openErr = status, &UpstreamError{Message: message}, nil
+			continue
 		}
-		if pendingImageSearchMarkdown != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{Content: pendingImageSearchMarkdown},
-					FinishReason: nil,
-				}},
+		result := openUpstream(r, &req, clientKey, token, tokenClass)
+		token, tokenClass = result.Token, result.TokenClass
+		usage.SetToken(token)
+		usage.TokenClass = tokenClass
+		w.Header().Set("X-Token-Class", tokenClass)
+		w.Header().Set("X-Upstream-Retries", strconv.Itoa(result.Retries))
+		if result.Session != "" {
+			w.Header().Set("X-Session", result.Session)
+		}
+		if result.Resp == nil {
+			failStatus, failErr, openErr = result.StatusCode, &UpstreamError{Message: "Upstream error"}, nil
+			if result.UpstreamErr != nil {
+				failErr = result.UpstreamErr
 			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingImageSearchMarkdown = ""
-		}
-
-		content := ""
-		reasoningContent := ""
-
-		if thinkingRemaining := thinkingFilter.Flush(); thinkingRemaining != "" {
-			thinkingFilter.lastOutputChunk = thinkingRemaining
-			processedRemaining := searchRefFilter.Process(thinkingRemaining)
-			if processedRemaining != "" {
-				hasContent = true
-				chunk := ChatCompletionChunk{
-					ID:      completionID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   modelName,
-					Choices: []Choice{{
-						Index:        0,
-						Delta:        Delta{ReasoningContent: processedRemaining},
-						FinishReason: nil,
-					}},
-				}
-				data, _ := json.Marshal(chunk)
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
+			if e, ok := result.Err.(*CircuitOpenError); ok {
+				failErr, openErr = circuitOpenError(e), e
 			}
-		}
-
-		if pendingSourcesMarkdown != "" && thinkingFilter.hasSeenFirstThinking {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{ReasoningContent: pendingSourcesMarkdown},
-					FinishReason: nil,
-				}},
+			// 只在 5xx、429、网络错误与熔断时回退，上游其它 4xx 直接返回
+			if failStatus >= 400 && failStatus < 500 && failStatus != http.StatusTooManyRequests {
+				break
 			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingSourcesMarkdown = ""
+			continue
 		}
-
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && editContent != "" {
-			if strings.Contains(editContent, "</details>") {
-				reasoningContent = thinkingFilter.ExtractIncrementalThinking(editContent)
-
-				if idx := strings.Index(editContent, "</details>"); idx != -1 {
-					afterDetails := editContent[idx+len("</details>"):]
-					if strings.HasPrefix(afterDetails, "\n") {
-						content = afterDetails[1:]
-					} else {
-						content = afterDetails
-					}
-					totalContentOutputLength = len([]rune(content))
-				}
-			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && editContent != "" {
-			fullContent := editContent
-			fullContentRunes := []rune(fullContent)
-
-			if len(fullContentRunes) > totalContentOutputLength {
-				content = string(fullContentRunes[totalContentOutputLength:])
-				totalContentOutputLength = len(fullContentRunes)
+		resp, modelName := result.Resp, result.ModelName
+		defer resp.Body.Close()
+		usage.UpstreamModel = modelName
+
+		recorder := newSessionRecorder(&req, completionID, modelName, clientToken, token)
+		recorder.SetOutputSettings(toolActivityEnabled(r.Context()), shapingFor(r.Context(), usage))
+		resp.Body = recorder.WrapBody(resp.Body)
+		w = recorder.WrapWriter(w)
+		defer recorder.Save()
+
+		// Vercel compatibility: Check explicitly if streaming is supported
+		// If Flusher is NOT supported, force non-streaming fallback
+		if req.Stream {
+			if flushable {
+				handleStreamResponse(r.Context(), w, resp.Body, completionID, modelName, usage, startResume())
 			} else {
-				content = fullContent
+				// Fallback to non-streaming logic even if client requested stream
+				// This works because buildUpstreamRequest ALWAYS sets stream=true, 
+				// and handleNonStreamResponse correctly consumes the SSE stream.
+				handleNonStreamResponse(r.Context(), w, resp.Body, completionID, modelName, true, usage)
 			}
+		} else {
+			handleNonStreamResponse(r.Context(), w, resp.Body, completionID, modelName, false, usage)
 		}
-
-		if reasoningContent != "" {
-			reasoningContent = searchRefFilter.Process(reasoningContent) + searchRefFilter.Flush()
-		}
-		if reasoningContent != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{ReasoningContent: reasoningContent},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-		}
-
-		if content == "" {
-			continue
-		}
-
-		content = searchRefFilter.Process(content)
-		if content == "" {
-			continue
-		}
-
-		hasContent = true
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			totalContentOutputLength += len([]rune(content))
-		}
-
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   modelName,
-			Choices: []Choice{{
-				Index:        0,
-				Delta:        Delta{Content: content},
-				FinishReason: nil,
-			}},
+		// 输出正常结束（未记录上游错误或客户端断开）才保存会话状态，下一轮才能续接本轮
+		if usage.Status == "" {
+			result.Turn.Commit()
 		}
-
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
-	}
-
-	if err := scanner.Err(); err != nil {
-		LogError("[Upstream] scanner error: %v", err)
-	}
-
-	if remaining := searchRefFilter.Flush(); remaining != "" {
-		hasContent = true
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   modelName,
-			Choices: []Choice{{
-				Index:        0,
-				Delta:        Delta{Content: remaining},
-				FinishReason: nil,
-			}},
-		}
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+		return
 	}
 
-	if !hasContent {
-		LogError("Stream response 200 but no content received")
+	if openErr != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(openErr.RetryAfter.Seconds()+0.999)))
+		usage.Fail(failStatus, "rejected")
+	} else {
+		usage.Fail(failStatus, "upstream_error")
 	}
-
-	stopReason := "stop"
-	finalChunk := ChatCompletionChunk{
-		ID:      completionID,
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   modelName,
-		Choices: []Choice{{
-			Index:        0,
-			Delta:        Delta{},
-			FinishReason: &stopReason,
-		}},
-	}
-
-	data, _ := json.Marshal(finalChunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	writeErrorResponse(w, failStatus, failErr)
 }
 
-func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, isStreamRequest bool) {
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	var chunks []string
-	var reasoningChunks []string
-	thinkingFilter := &ThinkingFilter{}
-	searchRefFilter := NewSearchRefFilter()
-	hasThinking := false
-	pendingSourcesMarkdown := ""
-	pendingImageSearchMarkdown := ""
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
-
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
-
-		if upstream.Data.Phase == "done" {
-			break
-		}
-
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			if thinkingFilter.lastPhase != "" && thinkingFilter.lastPhase != "thinking" {
-				thinkingFilter.ResetForNewRound()
-				thinkingFilter.thinkingRoundCount++
-				if thinkingFilter.thinkingRoundCount > 1 {
-					reasoningChunks = append(reasoningChunks, "\n\n")
-				}
-			}
-			thinkingFilter.lastPhase = "thinking"
-
-			hasThinking = true
-			reasoningContent := thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-			if reasoningContent != "" {
-				thinkingFilter.lastOutputChunk = reasoningContent
-				reasoningChunks = append(reasoningChunks, reasoningContent)
-			}
-			continue
-		}
-
-		if upstream.Data.Phase != "" {
-			thinkingFilter.lastPhase = upstream.Data.Phase
-		}
+// circuitOpenError 熔断时返回给客户端的错误
+func circuitOpenError(e *CircuitOpenError) *UpstreamError {
+	return &UpstreamError{Code: "circuit_open", Message: "Service unavailable: " + e.Error()}
+}
 
-		editContent := upstream.GetEditContent()
-		if editContent != "" && IsSearchResultContent(editContent) {
-			if results := ParseSearchResults(editContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
+// handleStreamResponse resume 不为 nil 时事件编号并缓存供续传
+func handleStreamResponse(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, usage *UsageRecord, resume *resumableStream) {
+	sse := newSSEWriter(w, completionID, modelName)
+	sse.resume = resume
+	defer sse.Close()
+	shaper := newStreamShaper(shapingFor(ctx, usage), func(delta Delta) error {
+		if err := sse.Chunk(delta, nil); err != nil {
+			return err
+		}
+		usage.AddOutput(delta.Content, delta.ReasoningContent)
+		return nil
+	})
+	defer shaper.Close()
+
+	toolActivity := toolActivityEnabled(ctx)
+	err := translateUpstream(ctx, body, func(ev TranslatedEvent) error {
+		switch ev.Kind {
+		case EventReasoning:
+			return shaper.Write(Delta{ReasoningContent: ev.Text})
+		case EventContent, EventCitations, EventImages:
+			return shaper.Write(Delta{Content: ev.Text})
+		case EventToolActivity:
+			if !toolActivity {
+				return nil
 			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"search_image"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				chunks = append(chunks, textBeforeBlock)
+			// 工具调用不经过整形器，先输出已缓冲的内容以保持顺序
+			if err := shaper.Flush(); err != nil {
+				return err
 			}
-			// 解析图片搜索结果
-			if results := ParseImageSearchResults(editContent); len(results) > 0 {
-				pendingImageSearchMarkdown = FormatImageSearchResults(results)
+			return sse.Chunk(Delta{ToolActivity: ev.Tool}, nil)
+		case EventError:
+			if err := shaper.Flush(); err != nil {
+				return err
 			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"mcp"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				chunks = append(chunks, textBeforeBlock)
+			usage.Fail(http.StatusBadGateway, "upstream_error")
+			return sse.Error(ev.Error)
+		case EventFinish:
+			// 结束时立即输出整形器中缓冲的全部内容
+			if err := shaper.Flush(); err != nil {
+				return err
 			}
-			continue
-		}
-		if editContent != "" && IsSearchToolCall(editContent, upstream.Data.Phase) {
-			continue
-		}
-
-		if pendingSourcesMarkdown != "" {
-			if hasThinking {
-				reasoningChunks = append(reasoningChunks, pendingSourcesMarkdown)
-			} else {
-				chunks = append(chunks, pendingSourcesMarkdown)
+			finishReason := ev.FinishReason
+			if err := sse.Chunk(Delta{}, &finishReason); err != nil {
+				return err
 			}
-			pendingSourcesMarkdown = ""
-		}
-		if pendingImageSearchMarkdown != "" {
-			chunks = append(chunks, pendingImageSearchMarkdown)
-			pendingImageSearchMarkdown = ""
+			return sse.Done()
 		}
+		return nil
+	})
+	if err != nil {
+		clientAborted(completionID, usage)
+	}
+}
 
-		content := ""
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && editContent != "" {
-			if strings.Contains(editContent, "</details>") {
-				reasoningContent := thinkingFilter.ExtractIncrementalThinking(editContent)
-				if reasoningContent != "" {
-					reasoningChunks = append(reasoningChunks, reasoningContent)
-				}
+func handleNonStreamResponse(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, isStreamRequest bool, usage *UsageRecord) {
+	// 只有响应不支持 Flush 时（如 Vercel）才以单个分块模拟流式输出：内容在结束时一次性发出，
+	// 汇总期间没有心跳，客户端断开要到最后写出时才会发现（ctx 取消时 translateUpstream 照常停止）
+	var sse *sseWriter
+	if isStreamRequest {
+		sse = newSSEWriter(w, completionID, modelName)
+		defer sse.Close()
+	}
 
-				if idx := strings.Index(editContent, "</details>"); idx != -1 {
-					afterDetails := editContent[idx+len("</details>"):]
-					if strings.HasPrefix(afterDetails, "\n") {
-						content = afterDetails[1:]
-					} else {
-						content = afterDetails
-					}
-				}
+	var content, reasoning strings.Builder
+	var upstreamErr *UpstreamError
+	var tools []ToolActivity
+	stopReason := "stop"
+	err := translateUpstream(ctx, body, func(ev TranslatedEvent) error {
+		switch ev.Kind {
+		case EventReasoning:
+			reasoning.WriteString(ev.Text)
+		case EventContent, EventCitations, EventImages:
+			content.WriteString(ev.Text)
+		case EventToolActivity:
+			if toolActivityEnabled(ctx) {
+				tools = mergeToolActivity(tools, ev.Tool)
 			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && editContent != "" {
-			content = editContent
-		}
-
-		if content != "" {
-			chunks = append(chunks, content)
+		case EventError:
+			upstreamErr = ev.Error
+		case EventFinish:
+			stopReason = ev.FinishReason
 		}
+		return nil
+	})
+	if err != nil {
+		clientAborted(completionID, usage)
+		return
 	}
-
-	fullContent := strings.Join(chunks, "")
-	fullContent = searchRefFilter.Process(fullContent) + searchRefFilter.Flush()
-	fullReasoning := strings.Join(reasoningChunks, "")
-	fullReasoning = searchRefFilter.Process(fullReasoning) + searchRefFilter.Flush()
-
-	if fullContent == "" {
-		if fullReasoning != "" {
-			// If we only have reasoning, that's fine, proceed.
-		} else {
-			LogError("Non-stream response 200 but no content received")
-		}
+	fullContent, fullReasoning := content.String(), reasoning.String()
+	usage.AddOutput(fullContent, fullReasoning)
+	if upstreamErr != nil {
+		usage.Fail(http.StatusBadGateway, "upstream_error")
 	}
 
-	stopReason := "stop"
-	
 	if isStreamRequest {
 		// Simulate streaming response
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   modelName,
-			Choices: []Choice{{
-				Index: 0,
-				Delta: Delta{
-					Content:          fullContent,
-					ReasoningContent: fullReasoning,
-				},
-				FinishReason: &stopReason,
-			}},
+		var err error
+		// 工具调用在内容之前，每个一个分块
+		for i := 0; i < len(tools) && err == nil; i++ {
+			err = sse.Chunk(Delta{ToolActivity: &tools[i]}, nil)
+		}
+		if err == nil && upstreamErr != nil {
+			// 与流式输出一致：已有内容、错误事件、finish_reason 为 error 的结束分块
+			if fullContent != "" || fullReasoning != "" {
+				err = sse.Chunk(Delta{Content: fullContent, ReasoningContent: fullReasoning}, nil)
+			}
+			if err == nil {
+				err = sse.Error(upstreamErr)
+			}
+			if err == nil {
+				err = sse.Chunk(Delta{}, &stopReason)
+			}
+		} else if err == nil {
+			err = sse.Chunk(Delta{Content: fullContent, ReasoningContent: fullReasoning}, &stopReason)
 		}
-		
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		// Try flush if possible, though likely not supported here
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
+		if err != nil || sse.Done() != nil {
+			clientAborted(completionID, usage)
 		}
+	} else if upstreamErr != nil {
+		// 回答不完整，按错误响应返回上游的 code 与 message
+		writeErrorResponse(w, http.StatusBadGateway, upstreamErr)
 	} else {
 		// Standard JSON response
 		response := ChatCompletionResponse{
@@ -882,6 +621,7 @@ func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completi
 					Role:             "assistant",
 					Content:          fullContent,
 					ReasoningContent: fullReasoning,
+					ToolActivity:     tools,
 				},
 				FinishReason: &stopReason,
 			}},
@@ -892,14 +632,26 @@ func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completi
 	}
 }
 
+// clientAborted 客户端在输出完成前断开，按 client_aborted 记录用量
+func clientAborted(completionID string, usage *UsageRecord) {
+	usage.Abort()
+	LogInfo("[Client] %s disconnected after %d chars", completionID, usage.PartialChars)
+}
+
 func HandleModels(w http.ResponseWriter, r *http.Request) {
-	var models []ModelInfo
-	for _, id := range ModelList {
-		models = append(models, ModelInfo{
-			ID:      id,
-			Object:  "model",
-			OwnedBy: "z.ai",
-		})
+	modelCatalog.refreshIfStale()
+	models := modelCatalog.Models()
+	for _, m := range routedModels() {
+		listed := false
+		for _, existing := range models {
+			if existing.ID == m.ID {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			models = append(models, m)
+		}
 	}
 
 	response := ModelsResponse{
@@ -2,12 +2,118 @@ package pkg
 
 import (
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
 	Port string
+
+	// 上游地址、超时与请求头
+	UpstreamBaseURL        string
+	UpstreamTimeout        time.Duration
+	UpstreamRequestTimeout time.Duration
+	UpstreamConnectTimeout time.Duration
+	UpstreamUserAgent      string
+	UpstreamAcceptLanguage string
+	UpstreamExtraHeaders   map[string]string
+
+	// 上游并发控制
+	MaxConcurrency   int
+	ModelConcurrency map[string]int
+	QueueMaxDepth    int
+	QueueTimeout     time.Duration
+	// 按 key 的 X-Priority 上限，"*" 为未列出 key 的上限，均未配置时为 0
+	KeyMaxPriority map[string]int
+
+	// 管理接口与用量账本
+	AdminToken      string
+	UsageLedgerPath string
+
+	// 上游 SSE 录制目录，为空时不录制
+	RecordDir string
+
+	// 按 key 的用量预算（JSON），周期按 BudgetTimezone 划分
+	KeyBudgets     string
+	BudgetTimezone string
+
+	// 上游账号池：邮箱密码账号自动登录续期，静态 token 直接使用
+	Accounts           string
+	AccountsFile       string // 每行一个 email:password，密码可包含逗号
+	StaticTokens       string
+	AuthBaseURL        string // 为空时使用 UpstreamBaseURL
+	TokenRefreshMargin time.Duration
+
+	// token 被上游拒绝（401/403/429）时的回退顺序，可选 pool、anonymous
+	TokenFallback      []string
+	TokenFallbackAllow []string
+	TokenFallbackDeny  []string
+	// token 被拒绝时换同类 token 的次数上限，与 RetryAttempts 分开计数
+	TokenRotateAttempts int
+
+	// 首字节前的上游重试：次数、指数退避区间与重试预算（每个请求存入 ratio 次重试额度，最多累积 burst 次）
+	RetryAttempts    int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	RetryBudgetRatio float64
+	RetryBudgetBurst int
+
+	// 按上游 host + 模型的熔断器：窗口内错误率或慢请求比例超过阈值时打开，快速返回 503
+	BreakerEnabled          bool
+	BreakerWindow           time.Duration
+	BreakerMinRequests      int
+	BreakerErrorRate        float64
+	BreakerSlowThreshold    time.Duration
+	BreakerSlowRate         float64
+	BreakerOpenDuration     time.Duration
+	BreakerHalfOpenRequests int
+
+	// OpenAI 兼容后端（JSON）与模型路由表
+	OpenAIBackends string
+	ModelRoutes    string
+
+	// 出站代理（http/https/socks5，可带认证），以及按账号绑定的出口代理
+	OutboundProxy   string
+	OutboundNoProxy string
+	TokenProxies    string
+
+	// 上游模型目录刷新间隔（0 关闭自动发现）与手动覆盖的映射
+	ModelRefreshInterval time.Duration
+	ModelOverrides       string
+
+	// 请求签名方案（JSON），SIGNER_CONFIG_FILE 变化时自动重新加载
+	SignerConfig     string
+	SignerConfigFile string
+
+	// 前端版本：FE_VERSION 固定使用该值，否则按 TTL 从上游首页刷新并缓存到 FeVersionCache
+	FeVersion      string
+	FeVersionTTL   time.Duration
+	FeVersionCache string
+
+	// 会话模式：off / header / auto，复用上游对话时只发送本轮新消息
+	SessionMode       string
+	SessionTTL        time.Duration
+	SessionMaxEntries int
+
+	// SSE 心跳：超过该间隔没有输出时发送，0 为关闭；格式为 comment 或 delta
+	// 不支持逐块刷新的响应（如 Vercel 缓冲输出）不发送心跳
+	SSEKeepaliveInterval time.Duration
+	SSEKeepaliveMode     string
+
+	// 流式输出整形策略（JSON），按 key 或模型合并小增量或匀速输出
+	StreamShaping string
+
+	// 流式输出续传：输出结束后保留事件的时间，为 0 时关闭
+	StreamResumeTTL time.Duration
+	// 每个流式输出缓存的最大字节数，超出时丢弃最早的事件，为 0 时不限制
+	StreamResumeMaxBytes int
+
+	// 是否在输出中附带上游工具调用（名称、参数、结果摘要），可按请求用 X-Tool-Activity 覆盖
+	ToolActivity bool
 }
 
 var Cfg *Config
@@ -22,5 +128,186 @@ func LoadConfig() {
 
 	Cfg = &Config{
 		Port: port,
+
+		UpstreamBaseURL:        strings.TrimRight(getEnv("UPSTREAM_BASE_URL", "https://chat.z.ai"), "/"),
+		UpstreamTimeout:        getEnvDuration("UPSTREAM_TIMEOUT", 300*time.Second),
+		UpstreamRequestTimeout: getEnvDuration("UPSTREAM_REQUEST_TIMEOUT", 15*time.Second),
+		UpstreamConnectTimeout: getEnvDuration("UPSTREAM_CONNECT_TIMEOUT", 10*time.Second),
+		UpstreamUserAgent:      os.Getenv("UPSTREAM_USER_AGENT"),
+		UpstreamAcceptLanguage: os.Getenv("UPSTREAM_ACCEPT_LANGUAGE"),
+		UpstreamExtraHeaders:   parseHeaderList(os.Getenv("UPSTREAM_EXTRA_HEADERS")),
+
+		MaxConcurrency:   getEnvInt("MAX_CONCURRENCY", 0),
+		ModelConcurrency: parseIntMap(os.Getenv("MODEL_CONCURRENCY")),
+		QueueMaxDepth:    getEnvInt("QUEUE_MAX_DEPTH", 100),
+		QueueTimeout:     getEnvDuration("QUEUE_TIMEOUT", 30*time.Second),
+		KeyMaxPriority:   parseIntMap(os.Getenv("KEY_MAX_PRIORITY")),
+
+		AdminToken:      os.Getenv("ADMIN_TOKEN"),
+		UsageLedgerPath: os.Getenv("USAGE_LEDGER_PATH"),
+
+		RecordDir: os.Getenv("RECORD_DIR"),
+
+		KeyBudgets:     os.Getenv("KEY_BUDGETS"),
+		BudgetTimezone: getEnv("BUDGET_TIMEZONE", "UTC"),
+
+		Accounts:           os.Getenv("ZAI_ACCOUNTS"),
+		AccountsFile:       os.Getenv("ZAI_ACCOUNTS_FILE"),
+		StaticTokens:       os.Getenv("ZAI_TOKENS"),
+		AuthBaseURL:        strings.TrimRight(os.Getenv("ZAI_AUTH_BASE_URL"), "/"),
+		TokenRefreshMargin: getEnvDuration("TOKEN_REFRESH_MARGIN", 10*time.Minute),
+
+		TokenFallback:       splitList(os.Getenv("TOKEN_FALLBACK")),
+		TokenFallbackAllow:  splitList(os.Getenv("TOKEN_FALLBACK_ALLOW")),
+		TokenFallbackDeny:   splitList(os.Getenv("TOKEN_FALLBACK_DENY")),
+		TokenRotateAttempts: getEnvInt("TOKEN_ROTATE_ATTEMPTS", 2),
+
+		RetryAttempts:    getEnvInt("UPSTREAM_RETRY_ATTEMPTS", 2),
+		RetryBaseDelay:   getEnvDuration("UPSTREAM_RETRY_BASE_DELAY", 200*time.Millisecond),
+		RetryMaxDelay:    getEnvDuration("UPSTREAM_RETRY_MAX_DELAY", 3*time.Second),
+		RetryBudgetRatio: getEnvFloat("UPSTREAM_RETRY_BUDGET_RATIO", 0.2),
+		RetryBudgetBurst: getEnvInt("UPSTREAM_RETRY_BUDGET_BURST", 10),
+
+		BreakerEnabled:          getEnv("BREAKER_ENABLED", "true") == "true",
+		BreakerWindow:           getEnvDuration("BREAKER_WINDOW", 60*time.Second),
+		BreakerMinRequests:      getEnvInt("BREAKER_MIN_REQUESTS", 10),
+		BreakerErrorRate:        getEnvFloat("BREAKER_ERROR_RATE", 0.5),
+		BreakerSlowThreshold:    getEnvDuration("BREAKER_SLOW_THRESHOLD", 30*time.Second),
+		BreakerSlowRate:         getEnvFloat("BREAKER_SLOW_RATE", 0.8),
+		BreakerOpenDuration:     getEnvDuration("BREAKER_OPEN_DURATION", 30*time.Second),
+		BreakerHalfOpenRequests: getEnvInt("BREAKER_HALF_OPEN_REQUESTS", 1),
+
+		OpenAIBackends: os.Getenv("OPENAI_BACKENDS"),
+		ModelRoutes:    os.Getenv("MODEL_ROUTES"),
+
+		OutboundProxy:   strings.TrimSpace(os.Getenv("OUTBOUND_PROXY")),
+		OutboundNoProxy: os.Getenv("OUTBOUND_NO_PROXY"),
+		TokenProxies:    os.Getenv("TOKEN_PROXIES"),
+
+		ModelRefreshInterval: getEnvDuration("MODEL_REFRESH_INTERVAL", time.Hour),
+		ModelOverrides:       os.Getenv("MODEL_OVERRIDES"),
+
+		SignerConfig:     strings.TrimSpace(os.Getenv("SIGNER_CONFIG")),
+		SignerConfigFile: os.Getenv("SIGNER_CONFIG_FILE"),
+
+		FeVersion:      strings.TrimSpace(os.Getenv("FE_VERSION")),
+		FeVersionTTL:   getEnvDuration("FE_VERSION_TTL", time.Hour),
+		FeVersionCache: getEnv("FE_VERSION_CACHE", filepath.Join(os.TempDir(), "zai-proxy-fe-version.json")),
+
+		SessionMode:       getEnv("SESSION_MODE", SessionModeOff),
+		SessionTTL:        getEnvDuration("SESSION_TTL", 6*time.Hour),
+		SessionMaxEntries: getEnvInt("SESSION_MAX_ENTRIES", 10000),
+
+		SSEKeepaliveInterval: getEnvDuration("SSE_KEEPALIVE_INTERVAL", 15*time.Second),
+		SSEKeepaliveMode:     strings.ToLower(getEnv("SSE_KEEPALIVE_MODE", KeepaliveComment)),
+
+		StreamShaping: os.Getenv("STREAM_SHAPING"),
+
+		StreamResumeTTL:      getEnvDuration("STREAM_RESUME_TTL", 0),
+		StreamResumeMaxBytes: getEnvInt("STREAM_RESUME_MAX_BYTES", 4<<20),
+
+		ToolActivity: getEnv("TOOL_ACTIVITY", "false") == "true",
+	}
+}
+
+func getEnv(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		LogWarn("Invalid %s=%q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		LogWarn("Invalid %s=%q, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// getEnvDuration 支持 "30s"、"5m" 等格式，纯数字按秒处理
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		LogWarn("Invalid %s=%q, using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// splitList 解析逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseIntMap 解析 "GLM-4.7=2,GLM-4.6=4" 格式的配置
+func parseIntMap(s string) map[string]int {
+	result := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			LogWarn("Invalid config entry %q, expected name=value", item)
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			LogWarn("Invalid config entry %q: %v", item, err)
+			continue
+		}
+		result[strings.TrimSpace(parts[0])] = n
+	}
+	return result
+}
+
+// parseHeaderList 解析 "X-Foo: bar; X-Baz: qux" 格式的请求头配置
+func parseHeaderList(s string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			LogWarn("Invalid header entry %q, expected Name: value", item)
+			continue
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
+	return result
 }
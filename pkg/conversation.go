@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 会话模式（SESSION_MODE）
+const (
+	SessionModeOff    = "off"    // 每个请求新建上游对话并发送完整历史
+	SessionModeHeader = "header" // 按 X-Conversation-ID 复用上游对话
+	SessionModeAuto   = "auto"   // 优先 X-Conversation-ID，缺省时按消息历史前缀识别
+)
+
+// ConversationHeader 客户端用于标识对话的请求头
+const ConversationHeader = "X-Conversation-ID"
+
+// upstreamConversation 客户端对话对应的上游对话与消息链
+type upstreamConversation struct {
+	ChatID     string
+	UserID     string // 上游对话属于该用户，换成其他用户的 token 后不能继续
+	ParentID   string // 上一轮助手消息 id，下一轮用户消息挂在它下面
+	PrefixHash string // 下一轮请求中最后一条用户消息之前的历史应有的哈希
+	expiresAt  time.Time
+}
+
+type cachedUpload struct {
+	file      *UpstreamFile
+	expiresAt time.Time
+}
+
+// ConversationStore 客户端对话到上游对话的映射，以及按上游用户缓存的已上传图片
+// 只保存在内存中，映射丢失（重启、过期、换 token）时回退为新建对话并发送完整历史
+type ConversationStore struct {
+	mu            sync.Mutex
+	mode          string
+	ttl           time.Duration
+	max           int
+	conversations map[string]*upstreamConversation
+	uploads       map[string]cachedUpload
+}
+
+// NewConversationStore 创建对话映射，max <= 0 表示不限制条目数
+func NewConversationStore(mode string, ttl time.Duration, max int) *ConversationStore {
+	return &ConversationStore{
+		mode:          mode,
+		ttl:           ttl,
+		max:           max,
+		conversations: make(map[string]*upstreamConversation),
+		uploads:       make(map[string]cachedUpload),
+	}
+}
+
+var upstreamConversations = NewConversationStore(SessionModeOff, 0, 0)
+
+// InitConversations 根据 SESSION_MODE 初始化对话映射
+func InitConversations() {
+	mode := strings.ToLower(Cfg.SessionMode)
+	switch mode {
+	case "", SessionModeOff:
+		mode = SessionModeOff
+	case SessionModeHeader, SessionModeAuto:
+		LogInfo("Session mode: %s (ttl=%s, max=%d)", mode, Cfg.SessionTTL, Cfg.SessionMaxEntries)
+	default:
+		LogWarn("Unknown SESSION_MODE %q, session mode disabled", Cfg.SessionMode)
+		mode = SessionModeOff
+	}
+	upstreamConversations = NewConversationStore(mode, Cfg.SessionTTL, Cfg.SessionMaxEntries)
+}
+
+// conversationTurn 一次对话请求在会话模式下的状态，由 buildUpstreamRequest 填写本轮使用的上游 id
+type conversationTurn struct {
+	store      *ConversationStore
+	key        string // 查找上一轮状态的键
+	nextKey    string // 保存本轮状态的键
+	prefixHash string
+	nextHash   string
+	turnStart  int // 本轮新消息在请求 messages 中的起始位置
+	prev       *upstreamConversation
+
+	// 以下由 buildUpstreamRequest 填写
+	Continued bool
+	ChatID    string
+	UserID    string
+	MessageID string
+}
+
+// historyHash 计算消息历史的哈希；助手消息只计入角色，不依赖客户端回传的回复文本是否与原文完全一致
+func historyHash(messages []Message) string {
+	h := sha256.New()
+	for _, msg := range messages {
+		h.Write([]byte(msg.Role))
+		h.Write([]byte{0})
+		if msg.Role != "assistant" {
+			text, imageURLs := msg.ParseContent()
+			h.Write([]byte(text))
+			for _, url := range imageURLs {
+				h.Write([]byte{0})
+				h.Write([]byte(url))
+			}
+		}
+		h.Write([]byte{1})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin 识别请求所属的对话，会话模式关闭或无法识别时返回 nil
+func (s *ConversationStore) Begin(r *http.Request, clientKey string, messages []Message) *conversationTurn {
+	if s.mode == SessionModeOff {
+		return nil
+	}
+	// 本轮新消息从最后一条用户消息开始；其后还有其他消息（如工具结果）时不支持续接
+	last := len(messages) - 1
+	if last < 0 || messages[last].Role != "user" {
+		return nil
+	}
+
+	prefix := messages[:last]
+	next := append(append([]Message(nil), messages...), Message{Role: "assistant"})
+	turn := &conversationTurn{
+		store:      s,
+		prefixHash: historyHash(prefix),
+		nextHash:   historyHash(next),
+		turnStart:  last,
+	}
+	if id := strings.TrimSpace(r.Header.Get(ConversationHeader)); id != "" {
+		turn.key = "h:" + clientKey + ":" + id
+		turn.nextKey = turn.key
+	} else if s.mode == SessionModeAuto {
+		turn.key = "p:" + clientKey + ":" + turn.prefixHash
+		turn.nextKey = "p:" + clientKey + ":" + turn.nextHash
+	} else {
+		return nil
+	}
+
+	if len(prefix) == 0 {
+		return turn
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conversations[turn.key]; ok && time.Now().Before(c.expiresAt) && c.PrefixHash == turn.prefixHash {
+		copied := *c
+		turn.prev = &copied
+	}
+	return turn
+}
+
+// continuation 返回可续接的上一轮状态；上游用户不同时不能续接
+func (t *conversationTurn) continuation(userID string) *upstreamConversation {
+	if t == nil || t.prev == nil || t.prev.UserID != userID {
+		return nil
+	}
+	return t.prev
+}
+
+// Commit 本轮输出正常结束后保存对话状态
+func (t *conversationTurn) Commit() {
+	if t == nil || t.ChatID == "" {
+		return
+	}
+	t.store.put(t.nextKey, &upstreamConversation{
+		ChatID:     t.ChatID,
+		UserID:     t.UserID,
+		ParentID:   t.MessageID,
+		PrefixHash: t.nextHash,
+	})
+}
+
+// Fallback 上游不再接受续接的对话时丢弃映射，之后以完整历史新建对话
+func (t *conversationTurn) Fallback() {
+	LogWarn("[Session] upstream chat %s no longer accepted, falling back to full history", t.ChatID)
+	t.store.mu.Lock()
+	delete(t.store.conversations, t.key)
+	t.store.mu.Unlock()
+	t.prev = nil
+	t.Continued = false
+}
+
+func (s *ConversationStore) put(key string, c *upstreamConversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	c.expiresAt = now.Add(s.ttl)
+	s.conversations[key] = c
+	if s.max > 0 && len(s.conversations) > s.max {
+		s.evict(now)
+	}
+}
+
+// evict 清理过期条目，仍超出上限时移除最早过期的条目，调用方需持有锁
+func (s *ConversationStore) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for k, c := range s.conversations {
+		if now.After(c.expiresAt) {
+			delete(s.conversations, k)
+			continue
+		}
+		if oldestKey == "" || c.expiresAt.Before(oldest) {
+			oldestKey, oldest = k, c.expiresAt
+		}
+	}
+	if len(s.conversations) > s.max {
+		delete(s.conversations, oldestKey)
+	}
+	for k, u := range s.uploads {
+		if now.After(u.expiresAt) {
+			delete(s.uploads, k)
+		}
+	}
+	for len(s.uploads) > s.max {
+		for k := range s.uploads {
+			delete(s.uploads, k)
+			break
+		}
+	}
+}
+
+func uploadKey(userID, imageURL string) string {
+	sum := sha256.Sum256([]byte(imageURL))
+	return userID + ":" + hex.EncodeToString(sum[:])
+}
+
+// upload 上传图片，同一上游用户已上传过的图片直接复用文件 id
+func (s *ConversationStore) upload(ctx context.Context, token, userID, imageURL string) (*UpstreamFile, error) {
+	key := uploadKey(userID, imageURL)
+	s.mu.Lock()
+	cached, ok := s.uploads[key]
+	s.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		file := *cached.file
+		return &file, nil
+	}
+
+	file, err := UploadImageFromURL(ctx, token, imageURL)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	now := time.Now()
+	s.uploads[key] = cachedUpload{file: file, expiresAt: now.Add(s.ttl)}
+	if s.max > 0 && len(s.uploads) > s.max {
+		s.evict(now)
+	}
+	s.mu.Unlock()
+	return file, nil
+}
@@ -0,0 +1,1473 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zai-proxy/pkg/fakeupstream"
+)
+
+var fake *fakeupstream.Server
+
+func TestMain(m *testing.M) {
+	LoadConfig()
+	Cfg.FeVersionCache = ""
+	currentLevel = ERROR
+
+	fake = fakeupstream.New()
+	server := httptest.NewServer(fake.Handler())
+	SetUpstream(NewZAIUpstream(UpstreamOptions{
+		BaseURL:        server.URL,
+		ChatTimeout:    10 * time.Second,
+		RequestTimeout: 5 * time.Second,
+		ConnectTimeout: 5 * time.Second,
+	}))
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+var userToken = fakeupstream.MakeToken("user-1", time.Hour)
+
+func doChat(t *testing.T, token string, req ChatRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	HandleChatCompletions(w, r)
+	return w
+}
+
+func userMessage(text string) []Message {
+	return []Message{{Role: "user", Content: text}}
+}
+
+type streamResult struct {
+	Content      string
+	Reasoning    string
+	FinishReason string
+	Done         bool
+}
+
+func parseStream(t *testing.T, body string) streamResult {
+	t.Helper()
+	var result streamResult
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		payload := strings.TrimPrefix(line, "data: ")
+		if payload == "[DONE]" {
+			result.Done = true
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", payload, err)
+		}
+		for _, choice := range chunk.Choices {
+			result.Content += choice.Delta.Content
+			result.Reasoning += choice.Delta.ReasoningContent
+			if choice.FinishReason != nil {
+				result.FinishReason = *choice.FinishReason
+			}
+		}
+	}
+	return result
+}
+
+func parseCompletion(t *testing.T, body []byte) ChatCompletionResponse {
+	t.Helper()
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid completion %q: %v", body, err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message == nil {
+		t.Fatalf("unexpected choices: %s", body)
+	}
+	return resp
+}
+
+const (
+	searchSources = "[\\[1\\] The Go Programming Language](https://go.dev)\n[\\[2\\] Go \\[wiki\\]](https://en.wikipedia.org/wiki/Go)\n\n"
+	searchAnswer  = "Go is a language[\\[1\\]](https://go.dev) made at Google[\\[2\\]](https://en.wikipedia.org/wiki/Go)."
+	imageAnswer   = "Looking for pictures.\n![A cat](https://img.example/cat.jpg)\n![Another \\[cat\\]](https://img.example/cat2.jpg)\nHere you go."
+)
+
+func TestStreamTranslation(t *testing.T) {
+	cases := []struct {
+		script    string
+		model     string
+		content   string
+		reasoning string
+	}{
+		{"default", "GLM-4.6", "Hello, world!", ""},
+		{"thinking", "GLM-4.7-thinking", "The answer is 42.", "Let me think\nabout it."},
+		{"search", "GLM-4.7-search", searchSources + searchAnswer, ""},
+		{"search_image", "GLM-4.6-V", imageAnswer, ""},
+		{"mcp", "GLM-4.6-V", "Part one. Part two. Part three.", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.script, func(t *testing.T) {
+			w := doChat(t, userToken, ChatRequest{Model: tc.model, Messages: userMessage(tc.script), Stream: true})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("content type %q", ct)
+			}
+			got := parseStream(t, w.Body.String())
+			if got.Content != tc.content {
+				t.Errorf("content\n got: %q\nwant: %q", got.Content, tc.content)
+			}
+			if got.Reasoning != tc.reasoning {
+				t.Errorf("reasoning\n got: %q\nwant: %q", got.Reasoning, tc.reasoning)
+			}
+			if got.FinishReason != "stop" || !got.Done {
+				t.Errorf("finish=%q done=%v", got.FinishReason, got.Done)
+			}
+		})
+	}
+}
+
+func TestNonStreamTranslation(t *testing.T) {
+	cases := []struct {
+		script    string
+		model     string
+		content   string
+		reasoning string
+	}{
+		{"default", "GLM-4.6", "Hello, world!", ""},
+		{"thinking", "GLM-4.7-thinking", "The answer is 42.", "Let me think\nabout it."},
+		{"search", "GLM-4.7-search", searchSources + searchAnswer, ""},
+		{"search_image", "GLM-4.6-V", imageAnswer, ""},
+		{"mcp", "GLM-4.6-V", "Part one. Part two. Part three.", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.script, func(t *testing.T) {
+			w := doChat(t, userToken, ChatRequest{Model: tc.model, Messages: userMessage(tc.script)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			resp := parseCompletion(t, w.Body.Bytes())
+			msg := resp.Choices[0].Message
+			if msg.Content != tc.content {
+				t.Errorf("content\n got: %q\nwant: %q", msg.Content, tc.content)
+			}
+			if msg.ReasoningContent != tc.reasoning {
+				t.Errorf("reasoning\n got: %q\nwant: %q", msg.ReasoningContent, tc.reasoning)
+			}
+		})
+	}
+}
+
+func TestUpstreamRequestShape(t *testing.T) {
+	fake.Reset()
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.7-thinking-search", Messages: userMessage("default")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	calls := fake.ChatCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", len(calls))
+	}
+	call := calls[0]
+	if call.Body["model"] != "glm-4.7" {
+		t.Errorf("model %v", call.Body["model"])
+	}
+	features, _ := call.Body["features"].(map[string]interface{})
+	if features["enable_thinking"] != true || features["auto_web_search"] != true {
+		t.Errorf("features %v", features)
+	}
+	if call.Query.Get("user_id") != "user-1" {
+		t.Errorf("user_id %q", call.Query.Get("user_id"))
+	}
+	if call.Header.Get("X-FE-Version") != "prod-fe-1.0.0" {
+		t.Errorf("fe version %q", call.Header.Get("X-FE-Version"))
+	}
+}
+
+func TestAnonymousToken(t *testing.T) {
+	w := doChat(t, "free", ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Token-Class"); got != TokenClassAnonymous {
+		t.Errorf("token class %q", got)
+	}
+}
+
+func TestImageUpload(t *testing.T) {
+	fake.Reset()
+	image := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("\x89PNG fake image"))
+	messages := []Message{{
+		Role: "user",
+		Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "default"},
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": image}},
+		},
+	}}
+
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: messages})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if fake.Uploads() != 1 {
+		t.Errorf("expected 1 upload, got %d", fake.Uploads())
+	}
+	calls := fake.ChatCalls()
+	if len(calls) != 1 || calls[0].Body["files"] == nil {
+		t.Fatalf("upstream request has no files: %+v", calls)
+	}
+
+	// 重试时复用已上传的文件
+	fake.Reset()
+	saved := Cfg.RetryBaseDelay
+	Cfg.RetryBaseDelay = time.Millisecond
+	defer func() { Cfg.RetryBaseDelay = saved }()
+	fake.FailNext(http.StatusBadGateway)
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: messages})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d after retry: %s", w.Code, w.Body.String())
+	}
+	if fake.Uploads() != 1 || len(fake.ChatCalls()) != 2 {
+		t.Errorf("expected 1 upload for 2 upstream calls, got %d uploads and %d calls", fake.Uploads(), len(fake.ChatCalls()))
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("unauthorized")})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpstreamErrorEvent(t *testing.T) {
+	const wantError = `{"error":{"message":"Too many concurrent requests","type":"upstream_error","code":"MODEL_CONCURRENCY_LIMIT"}}`
+
+	t.Run("stream", func(t *testing.T) {
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("upstream_error"), Stream: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "data: "+wantError+"\n\n") {
+			t.Errorf("missing error event in %s", body)
+		}
+		if got := parseStream(t, body); got.Content != "Partial" || got.FinishReason != FinishReasonError || !got.Done {
+			t.Errorf("stream %+v", got)
+		}
+	})
+
+	t.Run("non-stream", func(t *testing.T) {
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("upstream_error")})
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != wantError {
+			t.Errorf("body %s", got)
+		}
+	})
+
+	// type 为 error 的事件，code 为数字
+	events, done := NewTranslator().feedLine([]byte(`data: {"type":"error","data":{"code":429,"detail":"rate limited"}}`))
+	if !done || len(events) != 1 || events[0].Kind != EventError || *events[0].Error != (UpstreamError{Code: "429", Message: "rate limited"}) {
+		t.Errorf("error frame: done=%v events=%+v", done, events)
+	}
+
+	// 空的 error 字段不是错误，不结束输出
+	for _, field := range []string{`""`, `null`, `{}`, `{"code":0,"message":""}`} {
+		for _, line := range []string{
+			`data: {"type":"chat:completion","error":` + field + `,"data":{"phase":"answer","delta_content":"ok"}}`,
+			`data: {"type":"chat:completion","data":{"phase":"answer","delta_content":"ok","error":` + field + `}}`,
+		} {
+			events, done := NewTranslator().feedLine([]byte(line))
+			if done || len(events) != 1 || events[0].Kind != EventContent || events[0].Text != "ok" {
+				t.Errorf("%s: done=%v events=%+v", line, done, events)
+			}
+		}
+	}
+}
+
+func TestTokenFallback(t *testing.T) {
+	fake.Reset()
+	saved := Cfg.TokenFallback
+	Cfg.TokenFallback = []string{TokenClassAnonymous}
+	defer func() { Cfg.TokenFallback = saved }()
+
+	rejected := fakeupstream.MakeToken("user-rejected", time.Hour)
+	fake.RejectToken(rejected)
+
+	w := doChat(t, rejected, ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Token-Class"); got != TokenClassAnonymous {
+		t.Errorf("token class %q", got)
+	}
+	if len(fake.ChatCalls()) != 2 {
+		t.Errorf("expected 2 upstream calls, got %d", len(fake.ChatCalls()))
+	}
+
+	// 换 token 不受重试次数与重试预算限制
+	fake.Reset()
+	fake.RejectToken(rejected)
+	savedAttempts, savedBudget := Cfg.RetryAttempts, upstreamRetryBudget
+	Cfg.RetryAttempts, upstreamRetryBudget = 0, newRetryBudget(0, 0)
+	defer func() { Cfg.RetryAttempts, upstreamRetryBudget = savedAttempts, savedBudget }()
+	w = doChat(t, rejected, ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusOK || w.Header().Get("X-Token-Class") != TokenClassAnonymous {
+		t.Fatalf("status %d, token class %q without retry attempts", w.Code, w.Header().Get("X-Token-Class"))
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	fake.Reset()
+	saved := Cfg.RetryBaseDelay
+	Cfg.RetryBaseDelay = time.Millisecond
+	defer func() { Cfg.RetryBaseDelay = saved }()
+
+	fake.FailNext(http.StatusBadGateway, http.StatusServiceUnavailable)
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Upstream-Retries"); got != "2" {
+		t.Errorf("retries header %q", got)
+	}
+	if len(fake.ChatCalls()) != 3 {
+		t.Errorf("expected 3 upstream calls, got %d", len(fake.ChatCalls()))
+	}
+
+	fake.Reset()
+	fake.FailNext(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d after exhausting retries", w.Code)
+	}
+}
+
+func TestUpstreamCertificateError(t *testing.T) {
+	saved := upstream
+	defer SetUpstream(saved)
+	savedDelay := Cfg.RetryBaseDelay
+	Cfg.RetryBaseDelay = time.Millisecond
+	defer func() { Cfg.RetryBaseDelay = savedDelay }()
+
+	// 证书不受信任属于配置错误，不退避重试
+	server := httptest.NewUnstartedServer(fake.Handler())
+	server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	SetUpstream(NewZAIUpstream(UpstreamOptions{BaseURL: server.URL, ChatTimeout: 5 * time.Second, RequestTimeout: 5 * time.Second, ConnectTimeout: 5 * time.Second}))
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6", Messages: userMessage("default")})
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Upstream-Retries") != "0" {
+		t.Errorf("status %d retries %q", w.Code, w.Header().Get("X-Upstream-Retries"))
+	}
+	_, err := http.Get(server.URL)
+	if err == nil || isRetryableError(err) {
+		t.Errorf("certificate error %v retryable", err)
+	}
+
+	// 连接被拒绝与超时可以重试
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	if _, err := http.Get("http://" + addr); err == nil || !isRetryableError(err) {
+		t.Errorf("connection refused %v not retryable", err)
+	}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) }))
+	defer slow.Close()
+	if _, err := (&http.Client{Timeout: 10 * time.Millisecond}).Get(slow.URL); err == nil || !isRetryableError(err) {
+		t.Errorf("timeout %v not retryable", err)
+	}
+}
+
+func TestFeVersionRefresh(t *testing.T) {
+	fake.Reset()
+	if _, err := RefreshFeVersion(); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetFeVersion("prod-fe-2.0.0", true)
+	defer func() {
+		fake.SetFeVersion("prod-fe-1.0.0", false)
+		RefreshFeVersion()
+	}()
+
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("default")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := GetFeVersionStatus(); got.Version != "prod-fe-2.0.0" || got.Source != FeVersionSourceUpstream {
+		t.Errorf("fe version %+v", got)
+	}
+	calls := fake.ChatCalls()
+	if len(calls) != 2 || calls[1].Header.Get("X-FE-Version") != "prod-fe-2.0.0" {
+		t.Errorf("expected a retry with the refreshed version, got %d calls", len(calls))
+	}
+}
+
+func TestSessionMode(t *testing.T) {
+	fake.Reset()
+	saved := *Cfg
+	Cfg.SessionMode = SessionModeAuto
+	InitConversations()
+	defer func() {
+		*Cfg = saved
+		InitConversations()
+	}()
+
+	messages := userMessage("default")
+	chat := func() (*httptest.ResponseRecorder, map[string]interface{}) {
+		t.Helper()
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: messages})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		calls := fake.ChatCalls()
+		return w, calls[len(calls)-1].Body
+	}
+
+	w, first := chat()
+	if w.Header().Get("X-Session") != "new" {
+		t.Errorf("first turn session %q", w.Header().Get("X-Session"))
+	}
+
+	messages = append(messages, Message{Role: "assistant", Content: "Hello"}, Message{Role: "user", Content: "default"})
+	w, second := chat()
+	if w.Header().Get("X-Session") != "continued" {
+		t.Errorf("second turn session %q", w.Header().Get("X-Session"))
+	}
+	if second["chat_id"] != first["chat_id"] || second["current_user_message_parent_id"] != first["id"] {
+		t.Errorf("second turn not attached to the first: chat %v parent %v", second["chat_id"], second["current_user_message_parent_id"])
+	}
+	if n := len(second["messages"].([]interface{})); n != 1 {
+		t.Errorf("second turn sent %d messages, want only the new turn", n)
+	}
+
+	// 上游对话丢失后回退为新对话并发送完整历史
+	fake.ForgetChats()
+	messages = append(messages, Message{Role: "assistant", Content: "Hello"}, Message{Role: "user", Content: "default"})
+	w, third := chat()
+	if w.Header().Get("X-Session") != "new" || w.Header().Get("X-Upstream-Retries") != "1" {
+		t.Errorf("fallback session %q retries %q", w.Header().Get("X-Session"), w.Header().Get("X-Upstream-Retries"))
+	}
+	if third["chat_id"] == first["chat_id"] || len(third["messages"].([]interface{})) != len(messages) {
+		t.Errorf("fallback should start a new chat with the full history")
+	}
+
+	// 输出以上游错误结束的一轮不保存，下一轮不会续接到它
+	messages = userMessage("upstream_error")
+	if w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: messages}); w.Code != http.StatusBadGateway {
+		t.Fatalf("upstream error turn: status %d", w.Code)
+	}
+	messages = append(messages, Message{Role: "assistant", Content: "Partial"}, Message{Role: "user", Content: "default"})
+	if w, _ := chat(); w.Header().Get("X-Session") != "new" {
+		t.Errorf("turn after failed turn: session %q", w.Header().Get("X-Session"))
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "slow",
+		Events: []fakeupstream.Event{
+			{Phase: "thinking", DeltaContent: "<details>\n> Searching", DelayMs: 120},
+			{Phase: "answer", DeltaContent: "Found it.", DelayMs: 120},
+			{Phase: "done", Done: true},
+		},
+	})
+	saved := *Cfg
+	defer func() { *Cfg = saved }()
+	Cfg.SSEKeepaliveInterval = 30 * time.Millisecond
+
+	for _, mode := range []string{KeepaliveComment, KeepaliveDelta} {
+		t.Run(mode, func(t *testing.T) {
+			Cfg.SSEKeepaliveMode = mode
+			w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("slow"), Stream: true})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			body := w.Body.String()
+			comments := strings.Count(body, ": keepalive\n\n")
+			empty := strings.Count(body, `"delta":{},"finish_reason":null`)
+			if mode == KeepaliveComment && (comments == 0 || empty != 0) {
+				t.Errorf("comment mode: %d comments, %d empty chunks", comments, empty)
+			}
+			if mode == KeepaliveDelta && (empty == 0 || comments != 0) {
+				t.Errorf("delta mode: %d comments, %d empty chunks", comments, empty)
+			}
+			if got := parseStream(t, body); got.Content != "Found it." || !got.Done {
+				t.Errorf("stream %+v", got)
+			}
+		})
+	}
+
+	// 不支持 Flush 时内容在结束时一次性发出，不写入无法送达的心跳
+	Cfg.SSEKeepaliveMode = KeepaliveComment
+	body, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("slow"), Stream: true})
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+userToken)
+	w := httptest.NewRecorder()
+	HandleChatCompletions(struct{ http.ResponseWriter }{w}, r)
+	if strings.Contains(w.Body.String(), "keepalive") {
+		t.Errorf("buffered response has heartbeats: %s", w.Body.String())
+	}
+	if got := parseStream(t, w.Body.String()); got.Content != "Found it." || !got.Done {
+		t.Errorf("buffered stream %+v", got)
+	}
+}
+
+func TestClientAbort(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "abort",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "Part one."},
+			{Phase: "answer", DeltaContent: " Part two.", DelayMs: 2000},
+			{Phase: "done", Done: true},
+		},
+	})
+	before := requestsByStatus.snapshot()[UsageStatusClientAborted]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	body, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("abort"), Stream: true})
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+userToken)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	HandleChatCompletions(w, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler kept running %s after the client went away", elapsed)
+	}
+	if got := parseStream(t, w.Body.String()); got.Content != "Part one." || got.Done {
+		t.Errorf("stream %+v", got)
+	}
+	if after := requestsByStatus.snapshot()[UsageStatusClientAborted]; after != before+1 {
+		t.Errorf("client_aborted count %d -> %d", before, after)
+	}
+}
+
+func TestUpstreamDisconnect(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "cut",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "Half an"},
+			{Disconnect: true},
+		},
+	})
+
+	// 上游中途断开不是正常结束：输出错误事件，finish_reason 为 error，按 upstream_error 记录
+	t.Run("stream", func(t *testing.T) {
+		before := requestsByStatus.snapshot()["upstream_error"]
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("cut"), Stream: true})
+		body := w.Body.String()
+		if !strings.Contains(body, `"code":"upstream_read_error"`) {
+			t.Errorf("missing error event in %s", body)
+		}
+		if got := parseStream(t, body); got.Content != "Half an" || got.FinishReason != FinishReasonError || !got.Done {
+			t.Errorf("stream %+v", got)
+		}
+		if after := requestsByStatus.snapshot()["upstream_error"]; after != before+1 {
+			t.Errorf("upstream_error count %d -> %d", before, after)
+		}
+	})
+
+	t.Run("non-stream", func(t *testing.T) {
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("cut")})
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"code":"upstream_read_error"`) {
+			t.Errorf("status %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestToolActivity(t *testing.T) {
+	saved := *Cfg
+	defer func() { *Cfg = saved }()
+
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: userMessage("mcp"), Stream: true})
+	if strings.Contains(w.Body.String(), "tool_activity") {
+		t.Errorf("tool activity reported while disabled: %s", w.Body.String())
+	}
+
+	Cfg.ToolActivity = true
+	want := ToolActivity{ID: "call_3", Name: "vlm-image-recognition", Arguments: `{"image": "file-1"}`, Result: "a cat on a sofa", Status: "completed"}
+
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: userMessage("mcp"), Stream: true})
+	var tools []ToolActivity
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		var chunk ChatCompletionChunk
+		if payload, ok := strings.CutPrefix(line, "data: "); ok && json.Unmarshal([]byte(payload), &chunk) == nil {
+			if tool := chunk.Choices[0].Delta.ToolActivity; tool != nil {
+				tools = append(tools, *tool)
+			}
+		}
+	}
+	if len(tools) != 1 || tools[0] != want {
+		t.Errorf("stream tool activity %+v", tools)
+	}
+	if got := parseStream(t, w.Body.String()); got.Content != "Part one. Part two. Part three." {
+		t.Errorf("content %q", got.Content)
+	}
+
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: userMessage("search_image")})
+	msg := parseCompletion(t, w.Body.Bytes()).Choices[0].Message
+	if len(msg.ToolActivity) != 1 || msg.ToolActivity[0].Name != "search_image" ||
+		!strings.HasPrefix(msg.ToolActivity[0].Result, "Title: A cat; Link: https://img.example/cat.jpg") {
+		t.Errorf("non-stream tool activity %+v", msg.ToolActivity)
+	}
+	if msg.Content != imageAnswer {
+		t.Errorf("content %q", msg.Content)
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "resume",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "One."},
+			{Phase: "answer", DeltaContent: " Two.", DelayMs: 200},
+			{Phase: "answer", DeltaContent: " Three.", DelayMs: 100},
+			{Phase: "done", Done: true},
+		},
+	})
+	saved := *Cfg
+	defer func() { *Cfg = saved; InitStreamResume() }()
+	Cfg.StreamResumeTTL = time.Minute
+	InitStreamResume()
+
+	aborted := requestsByStatus.snapshot()[UsageStatusClientAborted]
+
+	// 首个连接在第一个分块之后断开，上游输出继续缓存
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	body, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("resume"), Stream: true})
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+userToken)
+	first := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		HandleChatCompletions(first, r)
+		close(finished)
+	}()
+
+	<-ctx.Done()
+	var completionID string
+	streamResumes.mu.Lock()
+	for id := range streamResumes.streams {
+		completionID = id
+	}
+	streamResumes.mu.Unlock()
+	if completionID == "" {
+		t.Fatal("stream was not registered")
+	}
+
+	resume := func(token, lastEventID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", ResumePath+"?id="+completionID, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Last-Event-ID", lastEventID)
+		w := httptest.NewRecorder()
+		HandleStreamResume(w, r)
+		return w
+	}
+
+	// 续接时上游仍在输出：先补发缺失的事件，再实时输出到结束
+	w := resume(userToken, "1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := parseStream(t, w.Body.String()); got.Content != " Two. Three." || got.FinishReason != "stop" || !got.Done {
+		t.Errorf("resumed stream %+v", got)
+	}
+	if !strings.HasPrefix(w.Body.String(), "id: 2\n") {
+		t.Errorf("resumed stream should start at event 2: %q", w.Body.String())
+	}
+
+	<-finished
+	if got := first.Header().Get("X-Resume-URL"); got != ResumePath+"?id="+completionID {
+		t.Errorf("X-Resume-URL %q", got)
+	}
+	if got := parseStream(t, first.Body.String()); got.Content != "One. Two. Three." || !got.Done {
+		t.Errorf("first stream %+v", got)
+	}
+	// 首个连接提前断开，即使输出已由续传补收也记为 client_aborted
+	if after := requestsByStatus.snapshot()[UsageStatusClientAborted]; after != aborted+1 {
+		t.Errorf("client_aborted count %d -> %d", aborted, after)
+	}
+
+	// 结束后在保留期内仍可从头续接；其他 key 不能续接
+	if got := parseStream(t, resume(userToken, "").Body.String()); got.Content != "One. Two. Three." || !got.Done {
+		t.Errorf("replayed stream %+v", got)
+	}
+	if w := resume("someone-else", "0"); w.Code != http.StatusNotFound {
+		t.Errorf("other key: status %d", w.Code)
+	}
+
+	// 路由失败的请求没有输出可续接，不留下缓存条目，续传接口直接返回 404
+	fake.AddScript(&fakeupstream.Script{Name: "resume_rejected", Status: http.StatusBadRequest, Body: `{"detail":"rejected"}`})
+	streamResumes.mu.Lock()
+	registered := len(streamResumes.streams)
+	streamResumes.mu.Unlock()
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("resume_rejected"), Stream: true})
+	if w.Code != http.StatusBadRequest || w.Header().Get("X-Resume-URL") != "" {
+		t.Errorf("failed request: status %d, X-Resume-URL %q", w.Code, w.Header().Get("X-Resume-URL"))
+	}
+	streamResumes.mu.Lock()
+	leaked := len(streamResumes.streams) - registered
+	streamResumes.mu.Unlock()
+	if leaked != 0 {
+		t.Errorf("failed request left %d resume entries", leaked)
+	}
+
+	// 超出缓存上限时丢弃最早的事件，早于保留范围的续传请求返回 410
+	Cfg.StreamResumeMaxBytes = 1
+	InitStreamResume()
+	capped := streamResumes.Start(completionID, ClientKeyID(userToken))
+	capped.Append([]byte("data: one\n\n"))
+	capped.Append([]byte("data: two\n\n"))
+	capped.Finish()
+	if w := resume(userToken, "0"); w.Code != http.StatusGone {
+		t.Errorf("dropped events: status %d", w.Code)
+	}
+	if w := resume(userToken, "1"); w.Code != http.StatusOK || w.Body.String() != "id: 2\ndata: two\n\n" {
+		t.Errorf("retained events: status %d, body %q", w.Code, w.Body.String())
+	}
+}
+
+// wsTestClient 测试用的最小 WebSocket 客户端
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, url, token string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET "+WebSocketPath+" HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nAuthorization: Bearer "+token+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %d %v", resp.StatusCode, resp.Header)
+	}
+	return &wsTestClient{conn: conn, br: br}
+}
+
+func (c *wsTestClient) send(t *testing.T, msg interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	c.writeFrame(t, 0x80|wsOpText, data)
+}
+
+// writeFrame 写出一个带掩码的帧，first 为第一个字节（FIN、RSV 与操作码）
+func (c *wsTestClient) writeFrame(t *testing.T, first byte, data []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{first, 0x80 | 126}
+	if len(data) < 126 {
+		frame[1] = 0x80 | byte(len(data))
+	} else {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	}
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readClose 读取服务端的关闭帧，返回状态码
+func (c *wsTestClient) readClose(t *testing.T) int {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, head[1]&0x7F)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	if head[0]&0x0F != wsOpClose || len(payload) < 2 {
+		t.Fatalf("expected close frame with status, got opcode %#x payload %q", head[0]&0x0F, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func (c *wsTestClient) read(t *testing.T) wsServerMessage {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		t.Fatal(err)
+	}
+	var msg wsServerMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid message %q: %v", data, err)
+	}
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "ws_slow",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "Part one."},
+			{Phase: "answer", DeltaContent: " Part two.", DelayMs: 2000},
+			{Phase: "done", Done: true},
+		},
+	})
+	// 被接管的连接不受 server.Close 管理，测试结束前等待处理函数返回，避免请求在后续测试中结束
+	handlerDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleWebSocket(w, r)
+		close(handlerDone)
+	}))
+	defer server.Close()
+	c := dialWebSocket(t, server.URL, userToken)
+	defer func() {
+		c.conn.Close()
+		<-handlerDone
+	}()
+
+	stream, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("default"), Stream: true})
+	slow, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("ws_slow"), Stream: true})
+	plain, _ := json.Marshal(ChatRequest{Model: "GLM-4.5", Messages: userMessage("thinking")})
+	c.send(t, map[string]interface{}{"id": "slow", "request": json.RawMessage(slow)})
+	c.send(t, map[string]interface{}{"id": "a", "request": json.RawMessage(stream)})
+	c.send(t, map[string]interface{}{"id": "b", "request": json.RawMessage(plain)})
+
+	content := map[string]string{}
+	finished := map[string]string{}
+	for len(finished) < 3 {
+		msg := c.read(t)
+		switch msg.Type {
+		case "chunk":
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal(msg.Data, &chunk); err != nil {
+				t.Fatalf("chunk %s: %v", msg.Data, err)
+			}
+			content[msg.ID] += chunk.Choices[0].Delta.Content
+			// 收到慢请求的第一个分块后取消它
+			if msg.ID == "slow" && content["slow"] == "Part one." {
+				c.send(t, map[string]string{"id": "slow", "type": "cancel"})
+			}
+		case "response":
+			resp := parseCompletion(t, msg.Data)
+			content[msg.ID] = resp.Choices[0].Message.Content
+			finished[msg.ID] = msg.Type
+		default:
+			finished[msg.ID] = msg.Type
+		}
+	}
+	want := map[string]string{"a": "done", "b": "response", "slow": "cancelled"}
+	for id, typ := range want {
+		if finished[id] != typ {
+			t.Errorf("%s finished with %q, want %q", id, finished[id], typ)
+		}
+	}
+	if content["a"] != "Hello, world!" || content["b"] != "The answer is 42." || content["slow"] != "Part one." {
+		t.Errorf("content %q", content)
+	}
+}
+
+func TestBudgetConcurrency(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "budget_slow",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "ok", DelayMs: 200},
+			{Phase: "done", Done: true},
+		},
+	})
+	const n = 5
+	saved := *Cfg
+	defer func() { *Cfg = saved; budgetTracker = nil }()
+	Cfg.KeyBudgets = fmt.Sprintf(`{"default":{"daily":{"requests":{"hard":%d}}}}`, n-1)
+	InitBudgets()
+
+	// 同一 key 的并发请求在任何一个结束前都已通过检查，预留保证最多 n-1 个通过
+	token := fakeupstream.MakeToken("budget-user", time.Hour)
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			codes <- doChat(t, token, ChatRequest{Model: "GLM-4.5", Messages: userMessage("budget_slow")}).Code
+		}()
+	}
+	count := map[int]int{}
+	for i := 0; i < n; i++ {
+		count[<-codes]++
+	}
+	if count[http.StatusOK] != n-1 || count[http.StatusTooManyRequests] != 1 {
+		t.Errorf("status counts %v", count)
+	}
+}
+
+func TestStreamShaping(t *testing.T) {
+	fake.AddScript(&fakeupstream.Script{
+		Name: "tiny",
+		Events: []fakeupstream.Event{
+			{Phase: "thinking", DeltaContent: "<details>\n> Let me"},
+			{Phase: "thinking", DeltaContent: " think"},
+			{Phase: "answer", DeltaContent: "A"},
+			{Phase: "answer", DeltaContent: "B"},
+			{Phase: "answer", DeltaContent: "C"},
+			{Phase: "answer", DeltaContent: "D"},
+			{Phase: "answer", DeltaContent: "E"},
+			{Phase: "done", Done: true},
+		},
+	})
+	saved := *Cfg
+	defer func() { *Cfg = saved; InitStreamShaping() }()
+
+	chunks := func(body string) int { return strings.Count(body, `"finish_reason":null`) }
+	stream := func(t *testing.T) (streamResult, int) {
+		w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5", Messages: userMessage("tiny"), Stream: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		return parseStream(t, w.Body.String()), chunks(w.Body.String())
+	}
+
+	Cfg.StreamShaping = ""
+	InitStreamShaping()
+	plain, plainChunks := stream(t)
+
+	// 合并后只在思考与回答切换处分块，内容不变
+	Cfg.StreamShaping = `{"model:GLM-4.5":{"mode":"coalesce","min_bytes":1024,"max_delay":"10s"}}`
+	InitStreamShaping()
+	got, n := stream(t)
+	if got != plain || n != 2 || n >= plainChunks {
+		t.Errorf("coalesce: %d chunks (plain %d), %+v vs %+v", n, plainChunks, got, plain)
+	}
+
+	// 匀速输出时结束前会立即输出全部积压内容
+	Cfg.StreamShaping = `{"*":{"mode":"pace","rate":1}}`
+	InitStreamShaping()
+	start := time.Now()
+	got, _ = stream(t)
+	if got != plain || time.Since(start) > 5*time.Second {
+		t.Errorf("pace: %+v vs %+v after %s", got, plain, time.Since(start))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fake.Reset()
+	saved := *Cfg
+	Cfg.RetryAttempts = 0
+	Cfg.BreakerMinRequests = 2
+	Cfg.BreakerErrorRate = 0.5
+	Cfg.BreakerOpenDuration = time.Hour
+	// 其他测试已在同一上游模型的熔断器中记录了成功请求
+	upstreamBreakers = NewBreakerRegistry()
+	defer func() {
+		*Cfg = saved
+		upstreamBreakers = NewBreakerRegistry()
+	}()
+
+	const model = "GLM-4.5-search"
+	fake.FailNext(http.StatusBadGateway, http.StatusBadGateway)
+	for i := 0; i < 2; i++ {
+		if w := doChat(t, userToken, ChatRequest{Model: model, Messages: userMessage("default")}); w.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+
+	w := doChat(t, userToken, ChatRequest{Model: model, Messages: userMessage("default")})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected fast 503 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	if len(fake.ChatCalls()) != 2 {
+		t.Errorf("open breaker should not call upstream, got %d calls", len(fake.ChatCalls()))
+	}
+
+	health := httptest.NewRecorder()
+	HandleHealth(health, httptest.NewRequest("GET", "/health", nil))
+	if !strings.Contains(health.Body.String(), `"status":"degraded"`) {
+		t.Errorf("health: %s", health.Body.String())
+	}
+	metrics := httptest.NewRecorder()
+	HandleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `model="`+GetTargetModel("GLM-4.5")+`"} 1`) {
+		t.Errorf("metrics: %s", metrics.Body.String())
+	}
+
+	// 同一上游模型的变体共用熔断器；模型目录之外的模型名共用 other，不会按请求创建新的熔断器
+	if w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5-thinking", Messages: userMessage("default")}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("variant of open model: status %d", w.Code)
+	}
+	before := len(upstreamBreakers.Snapshot())
+	for _, unknown := range []string{"no-such-model-1", "no-such-model-2", "no-such-model-3"} {
+		doChat(t, userToken, ChatRequest{Model: unknown, Messages: userMessage("default")})
+	}
+	if got := len(upstreamBreakers.Snapshot()); got != before+1 {
+		t.Errorf("unknown models created %d breakers", got-before)
+	}
+}
+
+func TestBackendFallback(t *testing.T) {
+	var gotModel string
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		gotModel, _ = body["model"].(string)
+		backendCalls++
+		if gotModel == "GLM-4.5-invalid" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"message":"invalid request","type":"invalid_request_error"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		// 输出部分内容后连接中断或输出错误帧
+		switch gotModel {
+		case "GLM-4.5-cut":
+			io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"content":"Partial"}}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case "GLM-4.5-errframe":
+			io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"content":"Partial"}}]}`+"\n\n")
+			io.WriteString(w, `data: {"error":{"message":"model overloaded","type":"server_error","code":"overloaded"}}`+"\n\n")
+			return
+		}
+		for _, chunk := range []string{
+			`{"id":"other","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"}}]}`,
+			`{"id":"other","choices":[{"index":0,"delta":{"content":" from backend"},"finish_reason":"length"}]}`,
+			`[DONE]`,
+		} {
+			io.WriteString(w, "data: "+chunk+"\n\n")
+		}
+	}))
+	defer backend.Close()
+
+	fake.Reset()
+	saved := *Cfg
+	Cfg.RetryAttempts = 0
+	Cfg.OpenAIBackends = `{"local":{"base_url":"` + backend.URL + `","models":{"GLM-4.5-route":"local-model"}}}`
+	Cfg.ModelRoutes = "GLM-4.5-route=zai,openai-compatible:local;GLM-4.5-invalid=openai-compatible:local,zai;GLM-4.5-zai=zai;" +
+		"GLM-4.5-cut=openai-compatible:local;GLM-4.5-errframe=openai-compatible:local"
+	InitBackends()
+	defer func() {
+		*Cfg = saved
+		InitBackends()
+	}()
+
+	fake.FailNext(http.StatusInternalServerError)
+	w := doChat(t, userToken, ChatRequest{Model: "GLM-4.5-route", Messages: userMessage("default"), Stream: true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Backend"); got != "openai-compatible:local" {
+		t.Errorf("backend header %q", got)
+	}
+	if gotModel != "local-model" {
+		t.Errorf("backend model %q", gotModel)
+	}
+	got := parseStream(t, w.Body.String())
+	if got.Content != "Hello from backend" || got.FinishReason != "length" || !got.Done {
+		t.Errorf("unexpected stream %+v", got)
+	}
+	if strings.Contains(w.Body.String(), `"id":"other"`) {
+		t.Errorf("backend completion id leaked: %s", w.Body.String())
+	}
+
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5-route", Messages: userMessage("default")})
+	if w.Code != http.StatusOK || w.Header().Get("X-Backend") != RouteZAI {
+		t.Fatalf("expected z.ai to serve when healthy: %d %q", w.Code, w.Header().Get("X-Backend"))
+	}
+	// 4xx 不回退，z.ai 与后端的错误都按 OpenAI 格式返回，保留原始的 message
+	errorBody := func(w *httptest.ResponseRecorder) ErrorResponse {
+		t.Helper()
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("error body %q (%s): %v", w.Body.String(), w.Header().Get("Content-Type"), err)
+		}
+		return resp
+	}
+	fake.Reset()
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5-invalid", Messages: userMessage("default")})
+	if e := errorBody(w).Error; w.Code != http.StatusBadRequest || e.Message != "invalid request" || e.Type != "invalid_request_error" || len(fake.ChatCalls()) != 0 {
+		t.Errorf("backend 4xx: status %d body %s, z.ai calls %d", w.Code, w.Body.String(), len(fake.ChatCalls()))
+	}
+	backendCalls = 0
+	fake.FailNext(http.StatusBadRequest)
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5-route", Messages: userMessage("default")})
+	if e := errorBody(w).Error; w.Code != http.StatusBadRequest || e.Message != "injected failure" || e.Type != "upstream_error" || backendCalls != 0 {
+		t.Errorf("z.ai 4xx: status %d body %s, backend calls %d", w.Code, w.Body.String(), backendCalls)
+	}
+
+	// z.ai 限流时回退到后端
+	fake.FailNext(http.StatusTooManyRequests)
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5-route", Messages: userMessage("default")})
+	if w.Code != http.StatusOK || w.Header().Get("X-Backend") != "openai-compatible:local" {
+		t.Errorf("z.ai 429: status %d backend %q", w.Code, w.Header().Get("X-Backend"))
+	}
+	for _, h := range []string{"X-Token-Class", "X-Upstream-Retries", "X-Session"} {
+		if v := w.Header().Get(h); v != "" {
+			t.Errorf("z.ai header %s=%q left on backend response", h, v)
+		}
+	}
+
+	// 所有目标都失败时返回最后一个目标的错误
+	fake.FailNext(http.StatusBadGateway)
+	w = doChat(t, userToken, ChatRequest{Model: "GLM-4.5-zai", Messages: userMessage("default")})
+	if e := errorBody(w).Error; w.Code != http.StatusBadGateway || e.Message != "injected failure" {
+		t.Errorf("z.ai 5xx: status %d body %s", w.Code, w.Body.String())
+	}
+
+	// 后端输出中断或输出错误帧时与 z.ai 路径一致：错误事件、finish_reason 为 error、非流式返回 502
+	for model, code := range map[string]string{"GLM-4.5-cut": "upstream_read_error", "GLM-4.5-errframe": "overloaded"} {
+		before := requestsByStatus.snapshot()["upstream_error"]
+		w = doChat(t, userToken, ChatRequest{Model: model, Messages: userMessage("default"), Stream: true})
+		if !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+			t.Errorf("%s: missing error event in %s", model, w.Body.String())
+		}
+		if got := parseStream(t, w.Body.String()); got.Content != "Partial" || got.FinishReason != FinishReasonError || !got.Done {
+			t.Errorf("%s: stream %+v", model, got)
+		}
+		if after := requestsByStatus.snapshot()["upstream_error"]; after != before+1 {
+			t.Errorf("%s: upstream_error count %d -> %d", model, before, after)
+		}
+		w = doChat(t, userToken, ChatRequest{Model: model, Messages: userMessage("default")})
+		if e := errorBody(w).Error; w.Code != http.StatusBadGateway || e.Code != code {
+			t.Errorf("%s non-stream: status %d body %s", model, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestModelDiscovery(t *testing.T) {
+	defer func() {
+		modelCatalog = newModelCatalog()
+	}()
+	fake.SetModels([]fakeupstream.Model{
+		{ID: "GLM-4-6-API-V1", Name: "GLM-4.6"},
+		{ID: "glm-4.7-v2", Name: "GLM-4.7"},
+		{ID: "glm-5-preview", Name: "GLM 5 Preview"},
+		{ID: "retired", Name: "Old Model", Inactive: true},
+	}, true)
+	if err := modelCatalog.Refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	sources := map[string]string{}
+	w := httptest.NewRecorder()
+	HandleModels(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var list ModelsResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	for _, m := range list.Data {
+		sources[m.ID] = m.Source
+	}
+	if sources["GLM-5-Preview"] != ModelSourceUpstream || sources["GLM-4.6"] != ModelSourceStatic || sources["GLM-4.7-thinking"] != ModelSourceUpstream {
+		t.Errorf("unexpected sources %v", sources)
+	}
+	if _, ok := sources["Old-Model"]; ok {
+		t.Errorf("inactive model listed")
+	}
+	if got := GetTargetModel("GLM-4.7-thinking"); got != "glm-4.7-v2" {
+		t.Errorf("renamed target %q", got)
+	}
+
+	// 刷新失败时保留上一次的目录
+	fake.SetModels(nil, false)
+	if err := modelCatalog.Refresh(); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if got := GetTargetModel("GLM-5-Preview"); got != "glm-5-preview" {
+		t.Errorf("last known catalog lost, target %q", got)
+	}
+	if modelCatalog.Status().LastError == "" {
+		t.Error("refresh error not reported")
+	}
+
+	// 目录过期时 /v1/models 在返回前完成刷新（Serverless 环境中后台刷新不保证执行）
+	fake.SetModels([]fakeupstream.Model{{ID: "glm-6-preview", Name: "GLM 6 Preview"}}, true)
+	modelCatalog.lastAttempt.Store(time.Now().Add(-2 * Cfg.ModelRefreshInterval).UnixNano())
+	w = httptest.NewRecorder()
+	HandleModels(w, httptest.NewRequest("GET", "/v1/models", nil))
+	if !strings.Contains(w.Body.String(), `"GLM-6-Preview"`) {
+		t.Errorf("stale catalog served: %s", w.Body.String())
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	tooBig := []byte{0x80 | wsOpBinary, 0x80 | 127}
+	tooBig = binary.BigEndian.AppendUint64(tooBig, wsMaxMessageSize+1)
+	tooBig = append(tooBig, 1, 2, 3, 4)
+	cases := []struct {
+		name string
+		send func(c *wsTestClient)
+		code int
+	}{
+		{"reserved bits", func(c *wsTestClient) { c.writeFrame(t, 0x80|0x40|wsOpText, []byte("{}")) }, wsCloseProtocolError},
+		{"unknown opcode", func(c *wsTestClient) { c.writeFrame(t, 0x80|0x3, []byte("{}")) }, wsCloseProtocolError},
+		{"fragmented ping", func(c *wsTestClient) { c.writeFrame(t, wsOpPing, []byte("ping")) }, wsCloseProtocolError},
+		{"long ping", func(c *wsTestClient) { c.writeFrame(t, 0x80|wsOpPing, bytes.Repeat([]byte("p"), 126)) }, wsCloseProtocolError},
+		{"unmasked", func(c *wsTestClient) { c.conn.Write([]byte{0x80 | wsOpText, 2, '{', '}'}) }, wsCloseProtocolError},
+		{"unexpected continuation", func(c *wsTestClient) { c.writeFrame(t, 0x80|wsOpContinuation, []byte("{}")) }, wsCloseProtocolError},
+		{"interleaved message", func(c *wsTestClient) {
+			c.writeFrame(t, wsOpText, []byte("{"))
+			c.writeFrame(t, 0x80|wsOpText, []byte("}"))
+		}, wsCloseProtocolError},
+		{"message too big", func(c *wsTestClient) { c.conn.Write(tooBig) }, wsCloseMessageTooBig},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dialWebSocket(t, server.URL, userToken)
+			defer c.conn.Close()
+			tc.send(c)
+			if code := c.readClose(t); code != tc.code {
+				t.Errorf("close code %d, want %d", code, tc.code)
+			}
+		})
+	}
+
+	// 分片消息中间可以插入不超过 125 字节的 ping
+	c := dialWebSocket(t, server.URL, userToken)
+	defer c.conn.Close()
+	c.writeFrame(t, wsOpText, []byte(`{"id":"x",`))
+	c.writeFrame(t, 0x80|wsOpPing, []byte("ping"))
+	c.writeFrame(t, 0x80|wsOpContinuation, []byte(`"type":"nope"}`))
+	var head [2]byte
+	io.ReadFull(c.br, head[:])
+	pong := make([]byte, head[1]&0x7F)
+	io.ReadFull(c.br, pong)
+	if head[0]&0x0F != wsOpPong || string(pong) != "ping" {
+		t.Fatalf("expected pong, got opcode %#x %q", head[0]&0x0F, pong)
+	}
+	if msg := c.read(t); msg.ID != "x" || msg.Type != "error" || msg.Status != http.StatusBadRequest {
+		t.Errorf("reassembled message %+v", msg)
+	}
+}
+
+func TestUsageLedgerScan(t *testing.T) {
+	ledger := &UsageLedger{path: filepath.Join(t.TempDir(), "usage.jsonl")}
+	for _, key := range []string{"a", "b"} {
+		if err := ledger.Append(&UsageRecord{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 扫描期间可以追加，新记录不出现在本次扫描中
+	var seen []string
+	done := make(chan error, 1)
+	go func() {
+		done <- ledger.Scan(func(rec *UsageRecord) {
+			seen = append(seen, rec.Key)
+			if err := ledger.Append(&UsageRecord{Key: rec.Key + "2"}); err != nil {
+				t.Error(err)
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Append blocked by Scan")
+	}
+	if strings.Join(seen, ",") != "a,b" {
+		t.Errorf("first scan saw %v", seen)
+	}
+
+	seen = nil
+	ledger.Scan(func(rec *UsageRecord) { seen = append(seen, rec.Key) })
+	if strings.Join(seen, ",") != "a,b,a2,b2" {
+		t.Errorf("second scan saw %v", seen)
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	saved := Cfg.KeyMaxPriority
+	defer func() { Cfg.KeyMaxPriority = saved }()
+
+	Cfg.KeyMaxPriority = map[string]int{"key-trusted": 10}
+	cases := []struct {
+		header, key string
+		want        int
+	}{
+		{"100", "key-trusted", 10},
+		{"5", "key-trusted", 5},
+		{"100", "key-other", 0},
+		{"-3", "key-other", -3},
+		{"abc", "key-other", 0},
+	}
+	for _, tc := range cases {
+		if got := requestPriority(tc.header, tc.key); got != tc.want {
+			t.Errorf("requestPriority(%q, %q) = %d, want %d", tc.header, tc.key, got, tc.want)
+		}
+	}
+
+	Cfg.KeyMaxPriority = map[string]int{"*": 2}
+	if got := requestPriority("100", "key-other"); got != 2 {
+		t.Errorf("default limit: got %d", got)
+	}
+}
+
+func TestTokenPoolSignIn(t *testing.T) {
+	const password = "p@ss,word:with:separators"
+	file := filepath.Join(t.TempDir(), "accounts.txt")
+	os.WriteFile(file, []byte("# pool accounts\npool@example.com:"+password+"\n"), 0o600)
+
+	saved := *Cfg
+	fake.Accounts = map[string]string{"pool@example.com": password}
+	defer func() {
+		*Cfg = saved
+		fake.Accounts = nil
+		InitTokenPool()
+	}()
+	Cfg.Accounts = ""
+	Cfg.AccountsFile = file
+	InitTokenPool()
+	if tokenPool.Size() != 1 {
+		t.Fatalf("pool size %d", tokenPool.Size())
+	}
+
+	// 登录在后台进行，完成前号池报告暂无 token
+	if _, err := tokenPool.Get(); err != ErrPoolSigningIn {
+		t.Fatalf("first Get: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		token, err := tokenPool.Get()
+		if err == nil {
+			if payload, _ := DecodeJWTPayload(token); payload == nil || payload.ID != "user-pool@example.com" {
+				t.Errorf("pooled token for %+v", payload)
+			}
+			break
+		}
+		if err != ErrPoolSigningIn || time.Now().After(deadline) {
+			t.Fatalf("sign-in did not finish: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecordingReplay(t *testing.T) {
+	const digest = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	fake.AddScript(&fakeupstream.Script{
+		Name: "record_hex",
+		Events: []fakeupstream.Event{
+			{Phase: "answer", DeltaContent: "sha256: " + digest},
+			{Phase: "done", Done: true},
+		},
+	})
+	// 事件之间有真实的间隔，整形后的分块边界取决于时间
+	paced := &fakeupstream.Script{Name: "record_paced"}
+	paced.Events = append(paced.Events, fakeupstream.Event{Phase: "thinking", DeltaContent: "<details>\n> Weighing the options"})
+	for _, word := range strings.Fields("The quick brown fox jumps over the lazy dog and keeps running far away") {
+		paced.Events = append(paced.Events, fakeupstream.Event{Phase: "answer", DeltaContent: word + " ", DelayMs: 30})
+	}
+	paced.Events = append(paced.Events, fakeupstream.Event{Phase: "done", Done: true})
+	fake.AddScript(paced)
+
+	saved := *Cfg
+	defer func() {
+		*Cfg = saved
+		InitStreamShaping()
+	}()
+	Cfg.RecordDir = t.TempDir()
+
+	load := func(script string) *Recording {
+		t.Helper()
+		doChat(t, userToken, ChatRequest{Model: "GLM-4.6-V", Messages: userMessage(script), Stream: true})
+		files, _ := filepath.Glob(filepath.Join(Cfg.RecordDir, "*.json"))
+		if len(files) == 0 {
+			t.Fatal("no recording saved")
+		}
+		rec, err := LoadRecording(files[len(files)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(files[len(files)-1])
+		return rec
+	}
+	replay := func(t *testing.T, rec *Recording) {
+		t.Helper()
+		Cfg.ToolActivity = false
+		Cfg.StreamShaping = ""
+		InitStreamShaping()
+		if diff := DiffServed(rec.Served, rec.Replay()); diff != nil {
+			t.Errorf("replay differs:\n%s", strings.Join(diff, "\n"))
+		}
+	}
+
+	// 整形后的分块边界与回放不同，但内容一致时不算差异
+	for _, policy := range []string{
+		`{"*":{"mode":"pace","rate":200}}`,
+		`{"*":{"mode":"coalesce","min_bytes":12,"max_delay":"20ms"}}`,
+	} {
+		Cfg.StreamShaping = policy
+		InitStreamShaping()
+		rec := load("record_paced")
+		if rec.Shaping == nil || strings.Count(rec.Served, `"finish_reason":null`) < 3 {
+			t.Fatalf("%s: shaping=%+v served:\n%s", policy, rec.Shaping, rec.Served)
+		}
+		replay(t, rec)
+	}
+
+	// 回放使用录制时的工具调用设置，与当前配置无关
+	Cfg.ToolActivity = true
+	rec := load("mcp")
+	if !rec.ToolActivity {
+		t.Fatal("tool_activity not recorded")
+	}
+	replay(t, rec)
+
+	// 内容不同时仍报告差异
+	if diff := DiffServed(rec.Served, strings.Replace(rec.Served, `"content":"`, `"content":"x`, 1)); diff == nil {
+		t.Error("changed content not reported")
+	}
+
+	// 回答中的十六进制串不是签名，原样保留；token 与已知签名字段被去除
+	rec = load("record_hex")
+	if !strings.Contains(strings.Join(rec.Upstream, "\n"), digest) || !strings.Contains(rec.Served, digest) {
+		t.Errorf("hex content redacted: %v", rec.Upstream)
+	}
+	if strings.Contains(rec.Served+strings.Join(rec.Upstream, ""), userToken) {
+		t.Error("token not redacted")
+	}
+	if got := redactUpstreamLine(`data: {"data":{"signature":"` + digest + `","delta_content":"` + digest + `"}}`); got != `data: {"data":{"delta_content":"`+digest+`","signature":"[REDACTED]"}}` {
+		t.Errorf("redacted line %s", got)
+	}
+}
@@ -0,0 +1,489 @@
+// Package fakeupstream 提供一个模拟 z.ai 的本地服务器，用于集成测试与问题复现
+// 支持匿名登录、邮箱登录、文件上传与 v2 对话接口，对话按脚本（fixture）输出 SSE 事件
+package fakeupstream
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//go:embed fixtures/*.json
+var builtinFixtures embed.FS
+
+// DefaultScript 找不到匹配脚本时使用的脚本名
+const DefaultScript = "default"
+
+// Event 脚本中的一个上游 SSE 事件
+type Event struct {
+	Type         string `json:"type,omitempty"` // 默认为 chat:completion
+	Phase        string `json:"phase,omitempty"`
+	DeltaContent string `json:"delta_content,omitempty"`
+	EditContent  string `json:"edit_content,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+	Raw          string `json:"raw,omitempty"`        // 不为空时原样输出这一行
+	DelayMs      int    `json:"delay_ms,omitempty"`   // 输出前等待的毫秒数
+	Disconnect   bool   `json:"disconnect,omitempty"` // 不输出事件，直接断开连接，模拟上游中途断开
+}
+
+// Script 一次对话的脚本，Status 非 0 且不为 200 时直接返回错误响应
+type Script struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Status      int     `json:"status,omitempty"`
+	Body        string  `json:"body,omitempty"`
+	Events      []Event `json:"events"`
+}
+
+// ChatCall 服务器收到的一次对话请求
+type ChatCall struct {
+	Query  url.Values
+	Header http.Header
+	Body   map[string]interface{}
+	Script string
+}
+
+// Model /api/models 返回的一个模型
+type Model struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Inactive bool   `json:"-"`
+}
+
+// Server 模拟的 z.ai 服务器
+type Server struct {
+	// FeVersion 首页中嵌入的前端版本号
+	FeVersion string
+	// RequireFeVersion 为 true 时 X-FE-Version 与 FeVersion 不一致的对话请求返回 400
+	RequireFeVersion bool
+	// Accounts 允许登录的邮箱与密码，为空时接受任意账号
+	Accounts map[string]string
+	// TokenTTL 签发 token 的有效期
+	TokenTTL time.Duration
+
+	mu       sync.Mutex
+	scripts  map[string]*Script
+	calls    []ChatCall
+	uploads  int
+	rejected map[string]bool
+	failures []int
+	models   []Model
+	modelsOK bool
+	chats    map[string]map[string]bool // chat_id -> 已生成的助手消息 id
+}
+
+// New 创建服务器并加载内置脚本
+func New() *Server {
+	s := &Server{
+		FeVersion: "prod-fe-1.0.0",
+		TokenTTL:  time.Hour,
+		scripts:   make(map[string]*Script),
+		rejected:  make(map[string]bool),
+		chats:     make(map[string]map[string]bool),
+		models: []Model{
+			{ID: "GLM-4-6-API-V1", Name: "GLM-4.6"},
+			{ID: "glm-4.7", Name: "GLM-4.7"},
+		},
+		modelsOK: true,
+	}
+	entries, _ := builtinFixtures.ReadDir("fixtures")
+	for _, entry := range entries {
+		data, err := builtinFixtures.ReadFile("fixtures/" + entry.Name())
+		if err != nil {
+			continue
+		}
+		if script, err := ParseScript(data); err == nil {
+			s.AddScript(script)
+		}
+	}
+	return s
+}
+
+// ParseScript 解析 JSON 格式的脚本
+func ParseScript(data []byte) (*Script, error) {
+	var script Script
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, err
+	}
+	if script.Name == "" {
+		return nil, fmt.Errorf("script has no name")
+	}
+	return &script, nil
+}
+
+// LoadDir 加载目录下所有 .json 脚本，同名脚本会覆盖内置脚本
+func (s *Server) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		script, err := ParseScript(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		s.AddScript(script)
+	}
+	return nil
+}
+
+// AddScript 注册脚本
+func (s *Server) AddScript(script *Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[script.Name] = script
+}
+
+// ScriptNames 返回已注册的脚本名
+func (s *Server) ScriptNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.scripts {
+		names = append(names, name)
+	}
+	return names
+}
+
+// RejectToken 之后使用该 token 的对话请求返回 401
+func (s *Server) RejectToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[token] = true
+}
+
+// FailNext 之后的 len(statuses) 个对话请求依次直接返回给定状态码，用于模拟上游临时故障
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// SetModels 设置 /api/models 返回的模型目录，ok 为 false 时该接口返回 500
+func (s *Server) SetModels(models []Model, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models = append([]Model(nil), models...)
+	s.modelsOK = ok
+}
+
+// SetFeVersion 更新首页中的前端版本号，require 为 true 时拒绝使用旧版本号的对话请求
+func (s *Server) SetFeVersion(version string, require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FeVersion = version
+	s.RequireFeVersion = require
+}
+
+// ForgetChats 丢弃所有对话，之后续接旧对话的请求返回 404，用于模拟上游对话被删除
+func (s *Server) ForgetChats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chats = make(map[string]map[string]bool)
+}
+
+// ChatCalls 返回收到的所有对话请求
+func (s *Server) ChatCalls() []ChatCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChatCall(nil), s.calls...)
+}
+
+// Uploads 返回收到的文件上传次数
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads
+}
+
+// Reset 清空请求记录
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.uploads = 0
+	s.rejected = make(map[string]bool)
+	s.failures = nil
+	s.chats = make(map[string]map[string]bool)
+}
+
+// Handler 返回服务器的 HTTP 处理器
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/auths/", s.handleAnonymousAuth)
+	mux.HandleFunc("/api/v1/auths/signin", s.handleSignIn)
+	mux.HandleFunc("/api/v1/files/", s.handleUpload)
+	mux.HandleFunc("/api/models", s.handleModels)
+	mux.HandleFunc("/api/v2/chat/completions", s.handleChat)
+	mux.HandleFunc("/", s.handleHome)
+	return mux
+}
+
+// MakeToken 签发一个不校验签名的 JWT，payload 包含 id 与 exp
+func MakeToken(userID string, ttl time.Duration) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":  userID,
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+	return header + "." + enc.EncodeToString(payload) + ".fake-signature"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	version := s.FeVersion
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<html><head><script src="/_app/%s/start.js"></script></head><body></body></html>`, version)
+}
+
+func (s *Server) handleAnonymousAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"id":    "guest-" + uuid.New().String()[:8],
+		"token": MakeToken("guest-"+uuid.New().String()[:8], s.TokenTTL),
+		"role":  "guest",
+	})
+}
+
+func (s *Server) handleSignIn(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "invalid body"})
+		return
+	}
+	if len(s.Accounts) > 0 && s.Accounts[body.Email] != body.Password {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "The email or password provided is incorrect."})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"id":    "user-" + body.Email,
+		"email": body.Email,
+		"token": MakeToken("user-"+body.Email, s.TokenTTL),
+	})
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+		return
+	}
+	defer file.Close()
+	size, _ := io.Copy(io.Discard, file)
+
+	s.mu.Lock()
+	s.uploads++
+	s.mu.Unlock()
+
+	id := uuid.New().String()
+	resp := map[string]interface{}{
+		"id":       id,
+		"user_id":  "fake",
+		"filename": header.Filename,
+		"meta": map[string]interface{}{
+			"name":         header.Filename,
+			"content_type": header.Header.Get("Content-Type"),
+			"size":         size,
+			"cdn_url":      "https://cdn.example.invalid/" + id,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"detail": "not authenticated"})
+		return
+	}
+	s.mu.Lock()
+	models, ok := s.models, s.modelsOK
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"detail": "catalog unavailable"})
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(models))
+	for _, m := range models {
+		data = append(data, map[string]interface{}{
+			"id":       m.ID,
+			"name":     m.Name,
+			"object":   "model",
+			"owned_by": "openai",
+			"info":     map[string]interface{}{"is_active": !m.Inactive},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+// selectScript 按最新用户消息（signature_prompt）选择同名脚本，找不到时使用 default
+func (s *Server) selectScript(prompt string) *Script {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if script, ok := s.scripts[strings.TrimSpace(prompt)]; ok {
+		return script
+	}
+	return s.scripts[DefaultScript]
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || r.URL.Query().Get("token") != token {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"detail": "missing token"})
+		return
+	}
+	if r.Header.Get("X-Signature") == "" || r.Header.Get("X-FE-Version") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "missing signature or fe version"})
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "invalid body"})
+		return
+	}
+	prompt, _ := body["signature_prompt"].(string)
+	script := s.selectScript(prompt)
+
+	s.mu.Lock()
+	version, outdated := s.FeVersion, s.RequireFeVersion && r.Header.Get("X-FE-Version") != s.FeVersion
+	rejected := s.rejected[token]
+	failure := 0
+	if len(s.failures) > 0 {
+		failure, s.failures = s.failures[0], s.failures[1:]
+	}
+	call := ChatCall{Query: r.URL.Query(), Header: r.Header.Clone(), Body: body}
+	if script != nil {
+		call.Script = script.Name
+	}
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+
+	if outdated {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": "Your frontend version is outdated. Minimum required: " + version})
+		return
+	}
+	if failure != 0 {
+		writeJSON(w, failure, map[string]string{"detail": "injected failure"})
+		return
+	}
+	if rejected {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"detail": "token rejected"})
+		return
+	}
+	if script == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "no script for prompt"})
+		return
+	}
+	// 带 current_user_message_parent_id 的请求续接已有对话，父消息必须存在
+	chatID, _ := body["chat_id"].(string)
+	messageID, _ := body["id"].(string)
+	parentID, _ := body["current_user_message_parent_id"].(string)
+	s.mu.Lock()
+	known := parentID == "" || s.chats[chatID][parentID]
+	if known {
+		if s.chats[chatID] == nil {
+			s.chats[chatID] = make(map[string]bool)
+		}
+		s.chats[chatID][messageID] = true
+	}
+	s.mu.Unlock()
+	if !known {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "chat not found"})
+		return
+	}
+	if script.Status != 0 && script.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(script.Status)
+		io.WriteString(w, script.Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for _, event := range script.Events {
+		if event.DelayMs > 0 {
+			select {
+			case <-time.After(time.Duration(event.DelayMs) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if event.Disconnect {
+			// 中止处理器时服务器直接关闭连接，不写出分块编码的结尾
+			panic(http.ErrAbortHandler)
+		}
+		if _, err := io.WriteString(w, FormatEvent(event)); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// FormatEvent 将脚本事件编码为上游 SSE 格式的一行（含结尾空行）
+func FormatEvent(event Event) string {
+	if event.Raw != "" {
+		return event.Raw + "\n\n"
+	}
+	eventType := event.Type
+	if eventType == "" {
+		eventType = "chat:completion"
+	}
+	data := map[string]interface{}{
+		"phase": event.Phase,
+		"done":  event.Done,
+	}
+	if event.DeltaContent != "" {
+		data["delta_content"] = event.DeltaContent
+	}
+	if event.EditContent != "" {
+		data["edit_content"] = event.EditContent
+		data["edit_index"] = 0
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"type": eventType,
+		"data": data,
+	})
+	return "data: " + string(payload) + "\n\n"
+}
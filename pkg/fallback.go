@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// 上游 token 的来源类别，通过 X-Token-Class 响应头告知客户端
+const (
+	TokenClassUser      = "user"
+	TokenClassPool      = "pool"
+	TokenClassAnonymous = "anonymous"
+)
+
+// isTokenRejected 判断上游状态码是否表示当前 token 不可用（未授权、被禁止或被限流）
+func isTokenRejected(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || statusCode == http.StatusTooManyRequests
+}
+
+// tokenFallbackAllowed 判断 key 是否允许回退到其它 token
+// TOKEN_FALLBACK_DENY 优先，TOKEN_FALLBACK_ALLOW 为空时允许所有 key
+func tokenFallbackAllowed(key string) bool {
+	if len(Cfg.TokenFallback) == 0 {
+		return false
+	}
+	if containsString(Cfg.TokenFallbackDeny, key) {
+		return false
+	}
+	if len(Cfg.TokenFallbackAllow) > 0 && !containsString(Cfg.TokenFallbackAllow, key) {
+		return false
+	}
+	return true
+}
+
+// fallbackToken 按 TOKEN_FALLBACK 配置的顺序获取一个不在 tried 中的 token
+func fallbackToken(tried ...string) (string, string, error) {
+	for _, class := range Cfg.TokenFallback {
+		switch class {
+		case TokenClassPool:
+			token, err := tokenPool.Get(tried...)
+			if err == nil {
+				return token, TokenClassPool, nil
+			}
+			LogDebug("[Fallback] pool unavailable: %v", err)
+		case TokenClassAnonymous:
+			token, err := GetAnonymousToken()
+			if err == nil {
+				return token, TokenClassAnonymous, nil
+			}
+			LogWarn("[Fallback] failed to get anonymous token: %v", err)
+		default:
+			LogWarn("[Fallback] unknown token class %q in TOKEN_FALLBACK", class)
+		}
+	}
+	return "", "", fmt.Errorf("no fallback token available")
+}
@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("upstream queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting for upstream slot")
+)
+
+// ConcurrencyLimiter 限制同时进行的上游请求数（全局与按模型）
+// 超出上限的请求进入有界优先队列，按优先级从高到低、同优先级先到先得的顺序放行
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	maxTotal int
+	maxModel map[string]int
+	maxQueue int
+	timeout  time.Duration
+
+	inFlight int
+	perModel map[string]int
+	queue    []*limiterWaiter
+	seq      uint64
+}
+
+type limiterWaiter struct {
+	model    string
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	granted  bool
+}
+
+// NewConcurrencyLimiter 创建限流器，maxTotal 或模型上限 <= 0 表示不限制
+func NewConcurrencyLimiter(maxTotal int, maxModel map[string]int, maxQueue int, timeout time.Duration) *ConcurrencyLimiter {
+	if maxModel == nil {
+		maxModel = make(map[string]int)
+	}
+	return &ConcurrencyLimiter{
+		maxTotal: maxTotal,
+		maxModel: maxModel,
+		maxQueue: maxQueue,
+		timeout:  timeout,
+		perModel: make(map[string]int),
+	}
+}
+
+var upstreamLimiter = NewConcurrencyLimiter(0, nil, 0, 0)
+
+// InitLimiter 根据配置初始化全局上游限流器
+func InitLimiter() {
+	upstreamLimiter = NewConcurrencyLimiter(Cfg.MaxConcurrency, Cfg.ModelConcurrency, Cfg.QueueMaxDepth, Cfg.QueueTimeout)
+	if Cfg.MaxConcurrency > 0 || len(Cfg.ModelConcurrency) > 0 {
+		LogInfo("Upstream concurrency limit: total=%d, per-model=%v, queue=%d, timeout=%s",
+			Cfg.MaxConcurrency, Cfg.ModelConcurrency, Cfg.QueueMaxDepth, Cfg.QueueTimeout)
+	}
+}
+
+// requestPriority 请求头 X-Priority 指定的排队优先级，不超过 KEY_MAX_PRIORITY 中 key 的上限
+// 未配置上限的 key 只能降低自己的优先级
+func requestPriority(header, key string) int {
+	priority, _ := strconv.Atoi(header)
+	limit, ok := Cfg.KeyMaxPriority[key]
+	if !ok {
+		limit = Cfg.KeyMaxPriority["*"]
+	}
+	if priority > limit {
+		return limit
+	}
+	return priority
+}
+
+// limiterModelKey 按基础模型名限流，-thinking/-search 变体共享同一配额
+func limiterModelKey(model string) string {
+	baseModel, _, _ := ParseModelName(model)
+	return baseModel
+}
+
+func (l *ConcurrencyLimiter) canRun(model string) bool {
+	if l.maxTotal > 0 && l.inFlight >= l.maxTotal {
+		return false
+	}
+	if max := l.maxModel[model]; max > 0 && l.perModel[model] >= max {
+		return false
+	}
+	return true
+}
+
+func (l *ConcurrencyLimiter) take(model string) {
+	l.inFlight++
+	l.perModel[model]++
+}
+
+// Acquire 获取一个上游槽位，返回释放函数和排队等待时间
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, model string, priority int) (func(), time.Duration, error) {
+	key := limiterModelKey(model)
+	start := time.Now()
+
+	l.mu.Lock()
+	// 队列中剩下的都是无法运行的请求，能直接运行说明不会插队到可运行的请求前面
+	if l.canRun(key) {
+		l.take(key)
+		l.mu.Unlock()
+		return l.releaseFunc(key), 0, nil
+	}
+	if len(l.queue) >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, 0, ErrQueueFull
+	}
+	l.seq++
+	waiter := &limiterWaiter{
+		model:    key,
+		priority: priority,
+		seq:      l.seq,
+		ready:    make(chan struct{}),
+	}
+	l.enqueue(waiter)
+	l.mu.Unlock()
+
+	var timeoutC <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	var err error
+	select {
+	case <-waiter.ready:
+		return l.releaseFunc(key), time.Since(start), nil
+	case <-timeoutC:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if waiter.granted {
+		// 超时与放行同时发生，槽位已分配，直接使用
+		return l.releaseFunc(key), time.Since(start), nil
+	}
+	l.remove(waiter)
+	return nil, time.Since(start), err
+}
+
+// enqueue 按优先级降序、序号升序插入
+func (l *ConcurrencyLimiter) enqueue(w *limiterWaiter) {
+	i := len(l.queue)
+	for i > 0 {
+		prev := l.queue[i-1]
+		if prev.priority >= w.priority {
+			break
+		}
+		i--
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+}
+
+func (l *ConcurrencyLimiter) remove(w *limiterWaiter) {
+	for i, q := range l.queue {
+		if q == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *ConcurrencyLimiter) releaseFunc(model string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(model) })
+	}
+}
+
+func (l *ConcurrencyLimiter) release(model string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.perModel[model]--
+	if l.perModel[model] <= 0 {
+		delete(l.perModel, model)
+	}
+
+	// 按队列顺序放行所有现在可以运行的请求
+	remaining := l.queue[:0]
+	for _, w := range l.queue {
+		if l.canRun(w.model) {
+			l.take(w.model)
+			w.granted = true
+			close(w.ready)
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	for i := len(remaining); i < len(l.queue); i++ {
+		l.queue[i] = nil
+	}
+	l.queue = remaining
+}
+
+// Stats 返回当前的并发与排队情况
+func (l *ConcurrencyLimiter) Stats() (inFlight int, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight, len(l.queue)
+}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// counterVec 带单个标签的计数器，标签为空时输出不带标签的指标
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]int64)}
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	c.values[label]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]int64, len(c.values))
+	for k, v := range c.values {
+		result[k] = v
+	}
+	return result
+}
+
+var (
+	requestsByStatus = newCounterVec()
+	upstreamRetries  = newCounterVec()
+)
+
+var startTime = time.Now()
+
+// HandleHealth 返回服务与各上游熔断器状态，有熔断器打开时 status 为 degraded
+func HandleHealth(w http.ResponseWriter, r *http.Request) {
+	breakers := upstreamBreakers.Snapshot()
+	status := "ok"
+	for _, b := range breakers {
+		if b.state != BreakerClosed {
+			status = "degraded"
+			break
+		}
+	}
+	inFlight, queued := upstreamLimiter.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"uptime_s": int64(time.Since(startTime).Seconds()),
+		"upstream": upstream.BaseURL(),
+		"limiter": map[string]int{
+			"in_flight": inFlight,
+			"queued":    queued,
+		},
+		"breakers":   breakers,
+		"models":     modelCatalog.Status(),
+		"signer":     CurrentSigner().Version(),
+		"fe_version": GetFeVersionStatus(),
+	})
+}
+
+// HandleMetrics 以 Prometheus 文本格式输出指标
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounter(w, "zai_proxy_requests_total", "Chat completion requests by final status.", "status", requestsByStatus.snapshot())
+	writeCounter(w, "zai_proxy_upstream_retries_total", "Upstream requests retried before the first byte.", "", upstreamRetries.snapshot())
+
+	inFlight, queued := upstreamLimiter.Stats()
+	writeGauge(w, "zai_proxy_upstream_in_flight", "Upstream requests currently running.", float64(inFlight))
+	writeGauge(w, "zai_proxy_upstream_queued", "Requests waiting for an upstream slot.", float64(queued))
+
+	breakers := upstreamBreakers.Snapshot()
+	fmt.Fprintln(w, "# HELP zai_proxy_breaker_state Circuit breaker state (0 closed, 1 open, 2 half-open).")
+	fmt.Fprintln(w, "# TYPE zai_proxy_breaker_state gauge")
+	for _, b := range breakers {
+		fmt.Fprintf(w, "zai_proxy_breaker_state{%s} %d\n", breakerLabels(b), b.state)
+	}
+	fmt.Fprintln(w, "# HELP zai_proxy_breaker_error_rate Upstream error rate within the breaker window.")
+	fmt.Fprintln(w, "# TYPE zai_proxy_breaker_error_rate gauge")
+	for _, b := range breakers {
+		fmt.Fprintf(w, "zai_proxy_breaker_error_rate{%s} %g\n", breakerLabels(b), b.ErrorRate)
+	}
+	fmt.Fprintln(w, "# HELP zai_proxy_breaker_slow_rate Share of slow upstream responses within the breaker window.")
+	fmt.Fprintln(w, "# TYPE zai_proxy_breaker_slow_rate gauge")
+	for _, b := range breakers {
+		fmt.Fprintf(w, "zai_proxy_breaker_slow_rate{%s} %g\n", breakerLabels(b), b.SlowRate)
+	}
+	fmt.Fprintln(w, "# HELP zai_proxy_breaker_opens_total Times the circuit breaker has opened.")
+	fmt.Fprintln(w, "# TYPE zai_proxy_breaker_opens_total counter")
+	for _, b := range breakers {
+		fmt.Fprintf(w, "zai_proxy_breaker_opens_total{%s} %d\n", breakerLabels(b), b.Opens)
+	}
+}
+
+func breakerLabels(b BreakerStatus) string {
+	return fmt.Sprintf(`host="%s",model="%s"`, escapeLabel(b.Host), escapeLabel(b.Model))
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func writeCounter(w io.Writer, name, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if label == "" {
+		fmt.Fprintf(w, "%s %d\n", name, values[""])
+		return
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), values[k])
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
@@ -8,6 +8,7 @@ import (
 )
 
 // Base model mapping (no suffix)
+// 静态映射，运行时会与上游目录和 MODEL_OVERRIDES 合并，见 catalog.go
 var BaseModelMapping = map[string]string{
 	"GLM-4.5":      "0727-360B-API",
 	"GLM-4.6":      "GLM-4-6-API-V1",
@@ -67,7 +68,7 @@ func IsSearchModel(model string) bool {
 
 func GetTargetModel(model string) string {
 	baseModel, _, _ := ParseModelName(model)
-	if target, ok := BaseModelMapping[baseModel]; ok {
+	if target, ok := modelCatalog.Target(baseModel); ok {
 		return target
 	}
 	// Default fallback to the model name itself if no mapping found
@@ -177,14 +178,16 @@ type Choice struct {
 }
 
 type Delta struct {
-	Content          string `json:"content,omitempty"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Content          string        `json:"content,omitempty"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	ToolActivity     *ToolActivity `json:"tool_activity,omitempty"` // 扩展字段，见 TOOL_ACTIVITY
 }
 
 type MessageResp struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string         `json:"role"`
+	Content          string         `json:"content"`
+	ReasoningContent string         `json:"reasoning_content,omitempty"`
+	ToolActivity     []ToolActivity `json:"tool_activity,omitempty"` // 扩展字段，见 TOOL_ACTIVITY
 }
 
 type ChatCompletionResponse struct {
@@ -204,6 +207,7 @@ type ModelInfo struct {
 	ID      string `json:"id"`
 	Object  string `json:"object"`
 	OwnedBy string `json:"owned_by"`
+	Source  string `json:"source,omitempty"` // static、upstream、override 或 route
 }
 
 var searchRefPattern = regexp.MustCompile(`【turn\d+search(\d+)】`)
@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 出站代理：OUTBOUND_PROXY 作用于所有上游与后端请求（包括图片下载、匿名登录），
+// TOKEN_PROXIES 可以为单个上游账号绑定独立的出口代理，未配置时沿用 HTTP(S)_PROXY 环境变量
+var (
+	outboundProxyURL *url.URL
+	outboundNoProxy  []string
+
+	tokenProxiesMu sync.RWMutex
+	tokenProxies   = map[string]*url.URL{}
+)
+
+type egressProxyKey struct{}
+
+// parseProxyURL 解析代理地址，支持 http、https、socks5、socks5h，认证信息写在 userinfo 中
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy has no host")
+	}
+	return u, nil
+}
+
+// InitOutboundProxy 解析 OUTBOUND_PROXY、OUTBOUND_NO_PROXY 与 TOKEN_PROXIES
+func InitOutboundProxy() {
+	outboundProxyURL = nil
+	if Cfg.OutboundProxy != "" {
+		u, err := parseProxyURL(Cfg.OutboundProxy)
+		if err != nil {
+			LogError("Invalid OUTBOUND_PROXY: %v", err)
+		} else {
+			outboundProxyURL = u
+			LogInfo("Using outbound proxy %s", u.Redacted())
+		}
+	}
+	outboundNoProxy = splitList(strings.ToLower(Cfg.OutboundNoProxy))
+
+	proxies := map[string]*url.URL{}
+	for _, item := range strings.Split(Cfg.TokenProxies, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			LogWarn("Invalid TOKEN_PROXIES entry, expected id=proxy")
+			continue
+		}
+		u, err := parseProxyURL(strings.TrimSpace(parts[1]))
+		if err != nil {
+			LogWarn("Invalid TOKEN_PROXIES entry for %s: %v", strings.TrimSpace(parts[0]), err)
+			continue
+		}
+		proxies[strings.TrimSpace(parts[0])] = u
+	}
+	tokenProxiesMu.Lock()
+	tokenProxies = proxies
+	tokenProxiesMu.Unlock()
+	if len(proxies) > 0 {
+		LogInfo("Per-account egress proxies: %d", len(proxies))
+	}
+}
+
+// aliasTokenProxy 账号登录后，让其 user id 使用为邮箱配置的代理
+func aliasTokenProxy(userID, email string) {
+	tokenProxiesMu.Lock()
+	defer tokenProxiesMu.Unlock()
+	if u, ok := tokenProxies[email]; ok && userID != "" {
+		tokenProxies[userID] = u
+	}
+}
+
+// tokenProxyContext 按顺序查找 ids（user id、邮箱或 anonymous）绑定的代理，找到时写入 ctx
+func tokenProxyContext(ctx context.Context, ids ...string) context.Context {
+	tokenProxiesMu.RLock()
+	defer tokenProxiesMu.RUnlock()
+	for _, id := range ids {
+		if u, ok := tokenProxies[id]; ok && id != "" {
+			return context.WithValue(ctx, egressProxyKey{}, u)
+		}
+	}
+	return ctx
+}
+
+// tokenUserID 从 token 中取出 user id，用于查找绑定的代理
+func tokenUserID(token string) string {
+	if payload, err := DecodeJWTPayload(token); err == nil && payload != nil {
+		return payload.ID
+	}
+	return ""
+}
+
+// bypassProxy 判断目标主机是否在 OUTBOUND_NO_PROXY 中（精确匹配或域名后缀匹配）
+func bypassProxy(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, entry := range outboundNoProxy {
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundProxy 用作 http.Transport.Proxy：请求上下文中绑定的代理优先，其次 OUTBOUND_PROXY，最后环境变量
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if u, ok := req.Context().Value(egressProxyKey{}).(*url.URL); ok {
+		return u, nil
+	}
+	if outboundProxyURL != nil {
+		if bypassProxy(req.URL.Host) {
+			return nil, nil
+		}
+		return outboundProxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxyFor 为固定代理地址（如后端单独配置的代理）构造 Transport.Proxy
+func proxyFor(proxy string) func(*http.Request) (*url.URL, error) {
+	if proxy == "" {
+		return outboundProxy
+	}
+	u, err := parseProxyURL(proxy)
+	if err != nil {
+		LogWarn("Invalid proxy %q: %v, using OUTBOUND_PROXY", proxy, err)
+		return outboundProxy
+	}
+	return http.ProxyURL(u)
+}
@@ -0,0 +1,421 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording 一次对话的原始上游 SSE 与当时返回给客户端的内容，用于复现与回放
+type Recording struct {
+	Version      int       `json:"version"`
+	Time         time.Time `json:"time"`
+	CompletionID string    `json:"completion_id"`
+	ModelName    string    `json:"model_name"`
+	Streamed     bool      `json:"streamed"` // 是否走了真实流式输出（客户端支持 Flush）
+	// 录制时生效的输出设置；回放按录制时的工具调用设置处理，整形设置仅供参考
+	ToolActivity bool           `json:"tool_activity,omitempty"`
+	Shaping      *StreamShaping `json:"shaping,omitempty"`
+	Request      ChatRequest    `json:"request"`
+	Upstream     []string       `json:"upstream"`
+	Served       string         `json:"served"`
+}
+
+const recordingVersion = 1
+
+// sensitiveFields 上游事件中按字段名去除的 token 与签名（不区分大小写）
+var sensitiveFields = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"signature":     true,
+	"x-signature":   true,
+}
+
+// redactSecrets 去除本次请求使用的客户端与上游 token，其余文本（如回答中的十六进制串）原样保留
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "[REDACTED]")
+		}
+	}
+	return s
+}
+
+// redactUpstreamLine 去除上游 data 事件中已知的 token 与签名字段，不是 JSON 的行原样返回
+func redactUpstreamLine(line string) string {
+	payload, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		return line
+	}
+	var v interface{}
+	if json.Unmarshal([]byte(payload), &v) != nil || !redactFields(v) {
+		return line
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return line
+	}
+	return "data: " + string(data)
+}
+
+// redactFields 递归替换 sensitiveFields 中的字段值，返回是否有替换
+func redactFields(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if sensitiveFields[strings.ToLower(k)] {
+				if child != nil && child != "" {
+					v[k] = "[REDACTED]"
+					changed = true
+				}
+				continue
+			}
+			if redactFields(child) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactFields(child) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// sessionRecorder 在请求处理过程中旁路记录上游与下游数据
+type sessionRecorder struct {
+	mu       sync.Mutex
+	rec      Recording
+	upstream bytes.Buffer
+	served   bytes.Buffer
+	secrets  []string
+}
+
+// newSessionRecorder 未配置 RECORD_DIR 时返回 nil，nil 接收者的方法均为空操作
+func newSessionRecorder(req *ChatRequest, completionID, modelName string, secrets ...string) *sessionRecorder {
+	if Cfg.RecordDir == "" {
+		return nil
+	}
+	return &sessionRecorder{
+		rec: Recording{
+			Version:      recordingVersion,
+			Time:         time.Now(),
+			CompletionID: completionID,
+			ModelName:    modelName,
+			Request:      *req,
+		},
+		secrets: secrets,
+	}
+}
+
+// WrapBody 记录从上游读取的所有字节
+func (s *sessionRecorder) WrapBody(body io.ReadCloser) io.ReadCloser {
+	if s == nil {
+		return body
+	}
+	return &teeReadCloser{Reader: io.TeeReader(body, &lockedWriter{mu: &s.mu, buf: &s.upstream}), Closer: body}
+}
+
+// WrapWriter 记录写给客户端的所有字节，保持原 ResponseWriter 是否支持 Flush 的特性
+func (s *sessionRecorder) WrapWriter(w http.ResponseWriter) http.ResponseWriter {
+	if s == nil {
+		return w
+	}
+	rw := &recordingWriter{ResponseWriter: w, out: &lockedWriter{mu: &s.mu, buf: &s.served}}
+	s.rec.Streamed = canFlush(w)
+	if flusher, ok := w.(http.Flusher); ok {
+		return &recordingFlushWriter{recordingWriter: rw, flusher: flusher}
+	}
+	return rw
+}
+
+// SetOutputSettings 记录本次请求的工具调用输出与流式整形设置
+func (s *sessionRecorder) SetOutputSettings(toolActivity bool, shaping StreamShaping) {
+	if s == nil {
+		return
+	}
+	s.rec.ToolActivity = toolActivity
+	if shaping.Mode != ShapingOff {
+		s.rec.Shaping = &shaping
+	}
+}
+
+// Save 写入 RECORD_DIR/<时间>-<completion id>.json
+func (s *sessionRecorder) Save() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	upstream := redactSecrets(s.upstream.String(), s.secrets)
+	s.rec.Served = redactSecrets(s.served.String(), s.secrets)
+	s.mu.Unlock()
+
+	for _, line := range strings.Split(upstream, "\n") {
+		if line != "" {
+			s.rec.Upstream = append(s.rec.Upstream, redactUpstreamLine(line))
+		}
+	}
+	// 请求中的图片 data URL 不含凭据，但消息文本可能包含用户粘贴的 token
+	if reqJSON, err := json.Marshal(s.rec.Request); err == nil {
+		var redacted ChatRequest
+		if json.Unmarshal([]byte(redactSecrets(string(reqJSON), s.secrets)), &redacted) == nil {
+			s.rec.Request = redacted
+		}
+	}
+
+	data, err := json.MarshalIndent(s.rec, "", "  ")
+	if err != nil {
+		LogError("[Recorder] Failed to encode recording: %v", err)
+		return
+	}
+	if err := os.MkdirAll(Cfg.RecordDir, 0o755); err != nil {
+		LogError("[Recorder] Failed to create %s: %v", Cfg.RecordDir, err)
+		return
+	}
+	name := fmt.Sprintf("%s-%s.json", s.rec.Time.Format("20060102-150405"), s.rec.CompletionID)
+	path := filepath.Join(Cfg.RecordDir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		LogError("[Recorder] Failed to write %s: %v", path, err)
+		return
+	}
+	LogDebug("[Recorder] Saved %s", path)
+}
+
+type lockedWriter struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	out io.Writer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.out.Write(p[:n])
+	return n, err
+}
+
+// Unwrap 供 http.ResponseController 访问原 ResponseWriter
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type recordingFlushWriter struct {
+	*recordingWriter
+	flusher http.Flusher
+}
+
+func (w *recordingFlushWriter) Flush() {
+	w.flusher.Flush()
+}
+
+// LoadRecording 读取录制文件
+func LoadRecording(path string) (*Recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.Version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", rec.Version)
+	}
+	return &rec, nil
+}
+
+// replayWriter 内存中的 ResponseWriter，用于回放
+type replayWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *replayWriter) Header() http.Header         { return w.header }
+func (w *replayWriter) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *replayWriter) WriteHeader(int)             {}
+
+type replayFlushWriter struct {
+	*replayWriter
+}
+
+func (w *replayFlushWriter) Flush() {}
+
+// Replay 将录制的上游 SSE 通过当前的转换逻辑重新处理，返回新的输出
+// 工具调用输出使用录制时的设置；整形依赖上游事件间隔，回放时上游数据没有间隔，
+// 因此回放不做整形，分块差异由 DiffServed 合并连续的文本增量后消除
+func (rec *Recording) Replay() string {
+	body := io.NopCloser(strings.NewReader(strings.Join(rec.Upstream, "\n") + "\n"))
+	rw := &replayWriter{header: make(http.Header)}
+	usage := NewUsageRecord("replay", &rec.Request)
+
+	ctx := context.Background()
+	if rec.ToolActivity {
+		ctx = context.WithValue(ctx, toolActivityKey{}, true)
+	}
+	ctx = context.WithValue(ctx, streamShapingKey{}, StreamShaping{Mode: ShapingOff})
+
+	if rec.Request.Stream && rec.Streamed {
+		handleStreamResponse(ctx, &replayFlushWriter{rw}, body, rec.CompletionID, rec.ModelName, usage, nil)
+	} else {
+		handleNonStreamResponse(ctx, rw, body, rec.CompletionID, rec.ModelName, rec.Request.Stream, usage)
+	}
+	return rw.body.String()
+}
+
+// normalizeServed 去除输出中每次都会变化的字段（created 时间戳），按行返回
+// 连续的同类文本增量合并为一个分块，使整形（合并或匀速输出）造成的分块差异不参与比较
+func normalizeServed(served string) []string {
+	var lines []string
+	var pending *ChatCompletionChunk
+	flush := func() {
+		if pending == nil {
+			return
+		}
+		if data, err := json.Marshal(pending); err == nil {
+			lines = append(lines, normalizeLine("data: "+string(data)))
+		}
+		pending = nil
+	}
+	for _, line := range strings.Split(served, "\n") {
+		// 心跳取决于当时的耗时，事件 id 取决于是否启用续传，不参与比较
+		if line == "" || strings.HasPrefix(line, ":") || strings.HasPrefix(line, "id: ") || isKeepaliveChunk(line) {
+			continue
+		}
+		if chunk := textChunk(line); chunk != nil {
+			if pending != nil && sameKind(pending.Choices[0].Delta, chunk.Choices[0].Delta) {
+				pending.Choices[0].Delta = appendDelta(pending.Choices[0].Delta, chunk.Choices[0].Delta)
+				continue
+			}
+			flush()
+			pending = chunk
+			continue
+		}
+		flush()
+		lines = append(lines, normalizeLine(line))
+	}
+	flush()
+	return lines
+}
+
+// textChunk 行是只含回答或思考增量的流式分块时返回解析结果，否则返回 nil
+func textChunk(line string) *ChatCompletionChunk {
+	payload, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		return nil
+	}
+	var chunk ChatCompletionChunk
+	if json.Unmarshal([]byte(payload), &chunk) != nil || chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 {
+		return nil
+	}
+	c := chunk.Choices[0]
+	if c.FinishReason != nil || c.Message != nil || c.Delta.ToolActivity != nil || (c.Delta.Content == "") == (c.Delta.ReasoningContent == "") {
+		return nil
+	}
+	return &chunk
+}
+
+// normalizeLine 去除一行输出中的 created 字段
+func normalizeLine(line string) string {
+	prefix := ""
+	payload := line
+	if strings.HasPrefix(line, "data: ") {
+		prefix = "data: "
+		payload = strings.TrimPrefix(line, "data: ")
+	}
+	var obj map[string]interface{}
+	if json.Unmarshal([]byte(payload), &obj) == nil {
+		delete(obj, "created")
+		if normalized, err := json.Marshal(obj); err == nil {
+			line = prefix + string(normalized)
+		}
+	}
+	return line
+}
+
+// DiffServed 比较录制时与回放时的输出，返回统一格式的差异行，无差异时为空
+func DiffServed(before, after string) []string {
+	a := normalizeServed(before)
+	b := normalizeServed(after)
+
+	// 最长公共子序列
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j >= len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			changed = true
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return diff
+}
+
+// isKeepaliveChunk 判断是否为 SSE_KEEPALIVE_MODE=delta 时发送的空 delta 心跳
+func isKeepaliveChunk(line string) bool {
+	payload, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		return false
+	}
+	var chunk ChatCompletionChunk
+	if json.Unmarshal([]byte(payload), &chunk) != nil || len(chunk.Choices) != 1 {
+		return false
+	}
+	c := chunk.Choices[0]
+	return c.FinishReason == nil && c.Delta == (Delta{}) && c.Message == nil
+}
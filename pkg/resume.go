@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResumePath 续传接口，参数 id 为 completion id，从 Last-Event-ID 之后继续输出
+const ResumePath = "/v1/chat/completions/resume"
+
+// resumableStream 一次流式输出中已编号的 SSE 事件，供断线的客户端续接
+// 缓存超过 STREAM_RESUME_MAX_BYTES 时丢弃最早的事件，续接点早于保留范围时无法续接
+type resumableStream struct {
+	mu         sync.Mutex
+	key        string // 只有发起请求的 key 可以续接
+	maxBytes   int
+	frames     [][]byte
+	dropped    int // 已丢弃的事件数，frames[0] 的 id 为 dropped+1
+	size       int
+	done       bool
+	finishedAt time.Time
+	wake       chan struct{} // 有新事件或输出结束时关闭并替换
+}
+
+// Append 为事件分配 id（从 1 开始）并缓存，返回带 id 行的完整事件
+func (s *resumableStream) Append(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame := append([]byte(fmt.Sprintf("id: %d\n", s.dropped+len(s.frames)+1)), data...)
+	s.frames = append(s.frames, frame)
+	s.size += len(frame)
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.frames) > 1 {
+		s.size -= len(s.frames[0])
+		s.frames[0] = nil
+		s.frames = s.frames[1:]
+		s.dropped++
+	}
+	close(s.wake)
+	s.wake = make(chan struct{})
+	return frame
+}
+
+// Finish 输出结束，之后续接的客户端收完缓存的事件即结束
+func (s *resumableStream) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.finishedAt = time.Now()
+	close(s.wake)
+}
+
+// since 返回 id 大于 lastID 的事件；未结束时 wake 在下一个事件到达时关闭
+// lastID 之后的事件已因超出缓存上限被丢弃时 ok 为 false
+func (s *resumableStream) since(lastID int) (frames [][]byte, done bool, wake <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lastID < s.dropped {
+		return nil, s.done, s.wake, false
+	}
+	if i := lastID - s.dropped; i < len(s.frames) {
+		frames = s.frames[i:]
+	}
+	return frames, s.done, s.wake, true
+}
+
+func (s *resumableStream) expired(ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done && time.Since(s.finishedAt) > ttl
+}
+
+// ResumeStore 按 completion id 保存流式输出，输出结束后保留 STREAM_RESUME_TTL，由后台定期清理
+// 只保存在内存中，多实例部署时续接请求需要落到同一实例
+type ResumeStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxBytes int
+	streams  map[string]*resumableStream
+	stop     chan struct{}
+}
+
+// streamResumes 未启用续传时为 nil
+var streamResumes *ResumeStore
+
+// InitStreamResume 根据 STREAM_RESUME_TTL 启用续传，为 0 时关闭
+func InitStreamResume() {
+	if streamResumes != nil {
+		close(streamResumes.stop)
+		streamResumes = nil
+	}
+	if Cfg.StreamResumeTTL <= 0 {
+		return
+	}
+	rs := &ResumeStore{
+		ttl:      Cfg.StreamResumeTTL,
+		maxBytes: Cfg.StreamResumeMaxBytes,
+		streams:  make(map[string]*resumableStream),
+		stop:     make(chan struct{}),
+	}
+	go rs.sweep(max(Cfg.StreamResumeTTL/2, time.Second))
+	streamResumes = rs
+	LogInfo("Stream resume enabled (ttl=%s, max_bytes=%d)", Cfg.StreamResumeTTL, Cfg.StreamResumeMaxBytes)
+}
+
+// sweep 定期清理已过期的输出
+func (rs *ResumeStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+		rs.mu.Lock()
+		for id, s := range rs.streams {
+			if s.expired(rs.ttl) {
+				delete(rs.streams, id)
+			}
+		}
+		rs.mu.Unlock()
+	}
+}
+
+// Start 开始缓存一次流式输出，未启用续传时返回 nil
+func (rs *ResumeStore) Start(completionID, key string) *resumableStream {
+	if rs == nil {
+		return nil
+	}
+	s := &resumableStream{key: key, maxBytes: rs.maxBytes, wake: make(chan struct{})}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.streams[completionID] = s
+	return s
+}
+
+// Get 查找未过期的流式输出
+func (rs *ResumeStore) Get(completionID string) *resumableStream {
+	if rs == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := rs.streams[completionID]
+	if s != nil && s.expired(rs.ttl) {
+		delete(rs.streams, completionID)
+		return nil
+	}
+	return s
+}
+
+// HandleStreamResume 续接一次流式输出：先补发 Last-Event-ID 之后的事件，再继续实时输出直到结束
+// 不支持设置请求头的客户端可以用 last_event_id 参数
+func HandleStreamResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if clientToken == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	completionID := r.URL.Query().Get("id")
+	stream := streamResumes.Get(completionID)
+	// 其他 key 的输出同样按不存在处理
+	if stream == nil || stream.key != ClientKeyID(clientToken) {
+		http.Error(w, "Stream not found or expired", http.StatusNotFound)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastID := 0
+	if lastEventID != "" {
+		n, err := strconv.Atoi(lastEventID)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = n
+	}
+	LogInfo("[Resume] %s from event %d", completionID, lastID)
+
+	if _, _, _, ok := stream.since(lastID); !ok {
+		http.Error(w, "Events after Last-Event-ID are no longer buffered", http.StatusGone)
+		return
+	}
+
+	sse := newSSEWriter(w, completionID, "")
+	defer sse.Close()
+	for {
+		frames, done, wake, ok := stream.since(lastID)
+		if !ok {
+			// 续接过程中落后于缓存上限，无法保证事件连续
+			return
+		}
+		for _, frame := range frames {
+			if sse.Frame(frame) != nil {
+				return
+			}
+		}
+		lastID += len(frames)
+		if done {
+			return
+		}
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
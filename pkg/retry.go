@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// retryBudget 令牌桶形式的重试预算：每个请求存入 ratio 个额度，每次重试消耗一个
+// 上游大面积故障时重试流量最多约为正常流量的 ratio 倍，避免重试放大故障
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+func newRetryBudget(burst int, ratio float64) *retryBudget {
+	return &retryBudget{tokens: float64(burst), max: float64(burst), ratio: ratio}
+}
+
+// Deposit 每个新请求调用一次
+func (b *retryBudget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// Withdraw 尝试消耗一次重试额度
+func (b *retryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var upstreamRetryBudget = newRetryBudget(10, 0.2)
+
+// InitRetryBudget 根据配置初始化全局重试预算
+func InitRetryBudget() {
+	upstreamRetryBudget = newRetryBudget(Cfg.RetryBudgetBurst, Cfg.RetryBudgetRatio)
+}
+
+// retryDelay 第 n 次重试（从 0 开始）前的等待时间：在 base*2^n 的一半到全部之间随机，且不超过 max
+func retryDelay(n int) time.Duration {
+	d := Cfg.RetryBaseDelay
+	for i := 0; i < n && d < Cfg.RetryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > Cfg.RetryMaxDelay {
+		d = Cfg.RetryMaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int64N(int64(d-half)+1))
+}
+
+// isRetryableStatus 上游临时故障
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableError 超时（含 TLS 握手超时）、连接被重置或拒绝、响应被截断可以重试；
+// 证书校验失败、代理配置错误、URL 无效等不会自行恢复的错误不重试
+func isRetryableError(err error) bool {
+	// http.Client.Do 的错误都包装为实现了 net.Error 的 *url.Error，需要先取出原始错误
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// upstreamResult 建立上游 SSE 连接的结果，失败时 StatusCode 为应返回给客户端的状态码
+type upstreamResult struct {
+	Resp       *http.Response
+	ModelName  string
+	Token      string
+	TokenClass string
+	Retries    int
+	StatusCode int
+	Err        error // 熔断器打开时为 *CircuitOpenError
+	// UpstreamErr 上游非 200 响应中的错误信息，返回给客户端
+	UpstreamErr *UpstreamError
+	Session     string // 会话模式下为 new 或 continued
+	// Turn 会话模式下本轮的对话状态，输出正常结束后由调用方 Commit
+	Turn *conversationTurn
+}
+
+// openUpstream 发起上游对话请求，在向客户端写出任何内容之前按配置重试
+// 5xx 与网络错误使用同一个 token 退避后重试，受 UPSTREAM_RETRY_ATTEMPTS 与重试预算限制；
+// token 被拒绝时换一个不同的 token 立即重试，受 TOKEN_ROTATE_ATTEMPTS 与 TOKEN_FALLBACK 限制，与前者互不占用
+func openUpstream(r *http.Request, req *ChatRequest, clientKey, token, tokenClass string) *upstreamResult {
+	res := &upstreamResult{Token: token, TokenClass: tokenClass}
+	tried := []string{token}
+	attempts, rotations := 0, 0
+	fallbackUsed := false
+	feVersionRefreshed := false
+	turn := upstreamConversations.Begin(r, clientKey, req.Messages)
+	uploads := newImageUploads(turn)
+	upstreamRetryBudget.Deposit()
+
+	breaker := upstreamBreakers.Get(upstream.BaseURL(), zaiBreakerModel(req.Model))
+	for {
+		if err := breaker.Allow(); err != nil {
+			LogWarn("[Breaker] key=%s rejected: %v", clientKey, err)
+			res.StatusCode = http.StatusServiceUnavailable
+			res.Err = err
+			return res
+		}
+
+		// 熔断器的耗时只统计对话请求本身，不含图片上传
+		var resp *http.Response
+		var latency time.Duration
+		chatReq, modelName, err := buildUpstreamRequest(r.Context(), res.Token, req.Messages, req.Model, turn, uploads)
+		if err == nil {
+			start := time.Now()
+			resp, err = upstream.ChatCompletions(r.Context(), chatReq)
+			latency = time.Since(start)
+		}
+		var retryable, rejected bool
+		if err != nil {
+			LogError("Upstream request failed: %v (retries=%d)", err, res.Retries)
+			res.StatusCode = http.StatusBadGateway
+			retryable = isRetryableError(err) && r.Context().Err() == nil
+			if retryable {
+				breaker.Record(outcomeFailure, latency)
+			} else {
+				breaker.Record(outcomeIgnore, latency)
+			}
+		} else if resp.StatusCode == http.StatusOK {
+			breaker.Record(outcomeSuccess, latency)
+			res.Resp = resp
+			res.ModelName = modelName
+			res.StatusCode = http.StatusOK
+			if turn != nil {
+				res.Turn = turn
+				res.Session = "new"
+				if turn.Continued {
+					res.Session = "continued"
+				}
+			}
+			if res.Retries > 0 {
+				LogInfo("[Retry] key=%s succeeded after %d retries", clientKey, res.Retries)
+			}
+			return res
+		} else {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+			resp.Body.Close()
+			LogError("Upstream error: status=%d, token_class=%s, retries=%d, body=%s", resp.StatusCode, res.TokenClass, res.Retries, string(body))
+			res.StatusCode = resp.StatusCode
+			res.UpstreamErr = parseErrorBody(body, http.StatusText(resp.StatusCode))
+
+			// 前端版本过旧：立即刷新版本，版本有变化时马上重试一次
+			if !feVersionRefreshed && isFeVersionError(resp.StatusCode, string(body)) {
+				feVersionRefreshed = true
+				breaker.Record(outcomeIgnore, latency)
+				old := GetFeVersionStatus().Version
+				if current, err := RefreshFeVersion(); err == nil && current != old {
+					LogWarn("[FeVersion] upstream rejected fe version %s, retrying with %s", old, current)
+					res.Retries++
+					upstreamRetries.Inc("")
+					continue
+				}
+				return res
+			}
+			rejected = isTokenRejected(resp.StatusCode)
+			retryable = isRetryableStatus(resp.StatusCode)
+
+			// 续接的上游对话不再被接受（对话被删除、消息链失效等）：丢弃映射，以完整历史立即重试
+			if turn != nil && turn.Continued && !rejected && !retryable {
+				breaker.Record(outcomeIgnore, latency)
+				turn.Fallback()
+				res.Retries++
+				upstreamRetries.Inc("")
+				continue
+			}
+			switch {
+			case retryable:
+				breaker.Record(outcomeFailure, latency)
+			case rejected:
+				breaker.Record(outcomeIgnore, latency)
+			default:
+				breaker.Record(outcomeSuccess, latency)
+			}
+		}
+
+		if !retryable && !rejected {
+			return res
+		}
+
+		var delay time.Duration
+		if rejected {
+			nextToken, nextClass, err := alternativeToken(res.TokenClass, clientKey, tried, &rotations, &fallbackUsed)
+			if err != nil {
+				LogDebug("[Retry] key=%s no alternative token: %v", clientKey, err)
+				return res
+			}
+			LogWarn("[Retry] key=%s retrying with %s token after status %d", clientKey, nextClass, res.StatusCode)
+			res.Token, res.TokenClass = nextToken, nextClass
+			tried = append(tried, nextToken)
+		} else {
+			if attempts >= Cfg.RetryAttempts {
+				return res
+			}
+			if !upstreamRetryBudget.Withdraw() {
+				LogWarn("[Retry] key=%s retry budget exhausted", clientKey)
+				return res
+			}
+			delay = retryDelay(attempts)
+			attempts++
+			LogWarn("[Retry] key=%s retry %d/%d in %s after status %d", clientKey, attempts, Cfg.RetryAttempts, delay, res.StatusCode)
+		}
+		res.Retries++
+		upstreamRetries.Inc("")
+
+		if err := sleepContext(r.Context(), delay); err != nil {
+			return res
+		}
+	}
+}
+
+// alternativeToken 选择一个未使用过的 token：号池与匿名 token 先换同类 token（最多 TOKEN_ROTATE_ATTEMPTS 次），
+// 之后按 TOKEN_FALLBACK 策略回退一次
+func alternativeToken(class, clientKey string, tried []string, rotations *int, fallbackUsed *bool) (string, string, error) {
+	if *rotations < Cfg.TokenRotateAttempts {
+		switch class {
+		case TokenClassPool:
+			if token, err := tokenPool.Get(tried...); err == nil {
+				*rotations++
+				return token, TokenClassPool, nil
+			}
+		case TokenClassAnonymous:
+			if token, err := GetAnonymousToken(); err == nil {
+				*rotations++
+				return token, TokenClassAnonymous, nil
+			}
+		}
+	}
+	if !*fallbackUsed && tokenFallbackAllowed(clientKey) {
+		token, nextClass, err := fallbackToken(tried...)
+		if err == nil {
+			*fallbackUsed = true
+		}
+		return token, nextClass, err
+	}
+	return "", "", fmt.Errorf("no alternative token for class %s", class)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
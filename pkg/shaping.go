@@ -0,0 +1,294 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 流式输出整形方式
+const (
+	ShapingOff      = "off"      // 每个上游增量输出一个分块
+	ShapingCoalesce = "coalesce" // 合并小增量，累计到 min_bytes 或等待 max_delay 后输出
+	ShapingPace     = "pace"     // 将突发的增量匀速输出，约 rate 字符/秒
+)
+
+// paceTick 匀速输出的时间粒度
+const paceTick = 50 * time.Millisecond
+
+// StreamShaping 流式输出整形策略
+type StreamShaping struct {
+	Mode     string `json:"mode"`
+	MinBytes int    `json:"min_bytes,omitempty"`
+	MaxDelay string `json:"max_delay,omitempty"`
+	Rate     int    `json:"rate,omitempty"`
+
+	maxDelay time.Duration
+}
+
+// streamShapings STREAM_SHAPING 中的策略，键为 "key:<key>"、"model:<模型名>" 或 "*"
+var streamShapings = map[string]StreamShaping{}
+
+// InitStreamShaping 解析 STREAM_SHAPING
+func InitStreamShaping() {
+	shapings := map[string]StreamShaping{}
+	if Cfg.StreamShaping != "" {
+		if err := json.Unmarshal([]byte(Cfg.StreamShaping), &shapings); err != nil {
+			LogError("Invalid STREAM_SHAPING: %v", err)
+			shapings = map[string]StreamShaping{}
+		}
+	}
+	for name, s := range shapings {
+		shapings[name] = s.normalize(name)
+	}
+	streamShapings = shapings
+	if len(shapings) > 0 {
+		LogInfo("Stream shaping: %d policies", len(shapings))
+	}
+}
+
+// normalize 填充默认值并解析 max_delay，name 用于日志
+func (s StreamShaping) normalize(name string) StreamShaping {
+	switch s.Mode {
+	case ShapingCoalesce:
+		if s.MinBytes <= 0 {
+			s.MinBytes = 32
+		}
+		s.maxDelay = 40 * time.Millisecond
+		if s.MaxDelay != "" {
+			d, err := time.ParseDuration(s.MaxDelay)
+			if err != nil {
+				LogWarn("STREAM_SHAPING %s: invalid max_delay %q: %v", name, s.MaxDelay, err)
+			} else {
+				s.maxDelay = d
+			}
+		}
+	case ShapingPace:
+		if s.Rate <= 0 {
+			s.Rate = 80
+		}
+	case ShapingOff, "":
+		s.Mode = ShapingOff
+	default:
+		LogWarn("STREAM_SHAPING %s: unknown mode %q, shaping disabled", name, s.Mode)
+		s.Mode = ShapingOff
+	}
+	return s
+}
+
+// streamShapingKey 回放时指定整形策略，不按当前配置选择
+type streamShapingKey struct{}
+
+// shapingFor 返回请求使用的整形策略
+func shapingFor(ctx context.Context, usage *UsageRecord) StreamShaping {
+	if s, ok := ctx.Value(streamShapingKey{}).(StreamShaping); ok {
+		return s
+	}
+	return streamShapingFor(usage.Key, usage.Model)
+}
+
+// streamShapingFor 按 key、完整模型名、基础模型名、"*" 的顺序选择策略
+func streamShapingFor(key, model string) StreamShaping {
+	baseModel, _, _ := ParseModelName(model)
+	for _, name := range []string{"key:" + key, "model:" + model, "model:" + baseModel, "*"} {
+		if s, ok := streamShapings[name]; ok {
+			return s
+		}
+	}
+	return StreamShaping{Mode: ShapingOff}
+}
+
+// streamShaper 位于翻译器与 SSE 输出之间，按策略合并或匀速输出增量
+// Flush 立即输出全部缓冲内容，结束时调用，不会被延迟
+type streamShaper interface {
+	Write(delta Delta) error
+	Flush() error
+	Close()
+}
+
+// newStreamShaper 创建整形器，write 为实际写出一个分块的函数
+func newStreamShaper(s StreamShaping, write func(Delta) error) streamShaper {
+	switch s.Mode {
+	case ShapingCoalesce:
+		return &coalescer{policy: s, write: write}
+	case ShapingPace:
+		p := &pacer{rate: s.Rate, write: write, stop: make(chan struct{}), stopped: make(chan struct{})}
+		go p.run()
+		return p
+	}
+	return passthroughShaper(write)
+}
+
+type passthroughShaper func(Delta) error
+
+func (p passthroughShaper) Write(delta Delta) error { return p(delta) }
+func (p passthroughShaper) Flush() error            { return nil }
+func (p passthroughShaper) Close()                  {}
+
+// sameKind 两个增量是否同为思考内容或同为回答内容
+func sameKind(a, b Delta) bool {
+	return (a.ReasoningContent != "") == (b.ReasoningContent != "")
+}
+
+func appendDelta(a, b Delta) Delta {
+	return Delta{Content: a.Content + b.Content, ReasoningContent: a.ReasoningContent + b.ReasoningContent}
+}
+
+// coalescer 合并小增量；思考与回答内容切换时先输出已缓冲的部分，保持顺序
+type coalescer struct {
+	mu      sync.Mutex
+	policy  StreamShaping
+	write   func(Delta) error
+	pending Delta
+	timer   *time.Timer
+	err     error
+	closed  bool
+}
+
+func (c *coalescer) Write(delta Delta) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.pending != (Delta{}) && !sameKind(c.pending, delta) {
+		c.flushLocked()
+	}
+	c.pending = appendDelta(c.pending, delta)
+	if len(c.pending.Content)+len(c.pending.ReasoningContent) >= c.policy.MinBytes {
+		c.flushLocked()
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.policy.maxDelay, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.timer = nil
+			if !c.closed {
+				c.flushLocked()
+			}
+		})
+	}
+	return c.err
+}
+
+// flushLocked 输出缓冲内容，调用方需持有锁
+func (c *coalescer) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.pending == (Delta{}) || c.err != nil {
+		return
+	}
+	c.err = c.write(c.pending)
+	c.pending = Delta{}
+}
+
+func (c *coalescer) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	return c.err
+}
+
+func (c *coalescer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// pacer 按 rate 字符/秒匀速输出；积压超过约 1 秒的量时加快，避免延迟无限增长
+type pacer struct {
+	mu      sync.Mutex
+	rate    int
+	write   func(Delta) error
+	queue   []Delta
+	backlog int // 队列中的字符数
+	err     error
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func (p *pacer) Write(delta Delta) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if n := len(p.queue); n > 0 && sameKind(p.queue[n-1], delta) {
+		p.queue[n-1] = appendDelta(p.queue[n-1], delta)
+	} else {
+		p.queue = append(p.queue, delta)
+	}
+	p.backlog += utf8.RuneCountInString(delta.Content) + utf8.RuneCountInString(delta.ReasoningContent)
+	return nil
+}
+
+func (p *pacer) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(paceTick)
+	defer ticker.Stop()
+	perTick := max(1, p.rate*int(paceTick)/int(time.Second))
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		n := max(perTick, p.backlog*int(paceTick)/int(time.Second))
+		p.emitLocked(n)
+		p.mu.Unlock()
+	}
+}
+
+// emitLocked 从队列中输出最多 n 个字符，n < 0 时输出全部，调用方需持有锁
+func (p *pacer) emitLocked(n int) {
+	for len(p.queue) > 0 && n != 0 && p.err == nil {
+		head := &p.queue[0]
+		text := &head.Content
+		if head.ReasoningContent != "" {
+			text = &head.ReasoningContent
+		}
+		out := *text
+		if count := utf8.RuneCountInString(out); n > 0 && count > n {
+			out = string([]rune(out)[:n])
+		}
+		*text = (*text)[len(out):]
+		chars := utf8.RuneCountInString(out)
+		p.backlog -= chars
+		if n > 0 {
+			n -= chars
+		}
+
+		chunk := Delta{Content: out}
+		if text == &head.ReasoningContent {
+			chunk = Delta{ReasoningContent: out}
+		}
+		p.err = p.write(chunk)
+		if *head == (Delta{}) {
+			p.queue = p.queue[1:]
+		}
+	}
+}
+
+func (p *pacer) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emitLocked(-1)
+	return p.err
+}
+
+func (p *pacer) Close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.stopped
+}
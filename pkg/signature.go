@@ -5,7 +5,13 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func hmacSha256Hex(key []byte, data string) string {
@@ -14,20 +20,213 @@ func hmacSha256Hex(key []byte, data string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func GenerateSignature(userID, requestID, userContent string, timestamp int64) string {
-	requestInfo := fmt.Sprintf("requestId,%s,timestamp,%d,user_id,%s", requestID, timestamp, userID)
-	contentBase64 := base64.StdEncoding.EncodeToString([]byte(userContent))
-	signData := fmt.Sprintf("%s|%s|%d", requestInfo, contentBase64, timestamp)
+// SignerVector 签名样例：给定输入时签名方案应得到的签名
+type SignerVector struct {
+	UserID    string `json:"user_id"`
+	RequestID string `json:"request_id"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+	Expected  string `json:"expected"`
+}
+
+// SignerParams 签名方案参数
+// 签名 = HMAC(HMAC(Key, timestamp/PeriodMs), DataLayout)，其中 DataLayout 中的 {request_info} 由 Layout 展开
+// 模板占位符：{request_id} {timestamp} {user_id} {content_base64} {request_info}
+type SignerParams struct {
+	Version    string         `json:"version"`
+	Key        string         `json:"key"`
+	Layout     string         `json:"layout"`
+	DataLayout string         `json:"data_layout"`
+	PeriodMs   int64          `json:"period_ms"`
+	Vectors    []SignerVector `json:"vectors,omitempty"`
+}
+
+// DefaultSignerParams 当前上游使用的签名方案
+var DefaultSignerParams = SignerParams{
+	Version:    "v1",
+	Key:        "key-@@@@)))()((9))-xxxx&&&%%%%%",
+	Layout:     "requestId,{request_id},timestamp,{timestamp},user_id,{user_id}",
+	DataLayout: "{request_info}|{content_base64}|{timestamp}",
+	PeriodMs:   5 * 60 * 1000,
+	// 回归样例：由本实现生成，不是从上游流量中抓取的，只能发现本实现的意外改动，不能证明与上游算法一致
+	// 需要校验上游时，用浏览器请求中的 X-Signature 及对应参数构造样例，通过 signer-test -vectors 检查
+	Vectors: []SignerVector{
+		{UserID: "user-1", RequestID: "2f1c0f7e-1a2b-4c3d-9e8f-001122334455", Content: "hello", Timestamp: 1735689600000, Expected: "e6ed46706e46e8c564065a94f522fef58686e8915e82b5d7bd3e383550786cf4"},
+		{UserID: "c9d8e7f6-0000-4111-8222-333344445555", RequestID: "req-unicode", Content: "你好，世界 🌏", Timestamp: 1760000123456, Expected: "3fe84f660695a0ba6ee42547fbc23e9aca43bac92c602ec56d41009278f1b9b1"},
+		{UserID: "guest-abc", RequestID: "req-empty", Content: "", Timestamp: 1700000000000, Expected: "97dc1836a4443ee1bf258fcb10b61a0078678950eca5d0a9e65eef71a1b383d7"},
+	},
+}
+
+// Signer 按 SignerParams 生成请求签名
+type Signer struct {
+	params SignerParams
+}
+
+// NewSigner 校验参数并创建签名器
+func NewSigner(params SignerParams) (*Signer, error) {
+	if params.Version == "" {
+		return nil, fmt.Errorf("signer version is required")
+	}
+	if params.Key == "" {
+		return nil, fmt.Errorf("signer key is required")
+	}
+	if params.PeriodMs <= 0 {
+		return nil, fmt.Errorf("signer period_ms must be positive")
+	}
+	if !strings.Contains(params.DataLayout, "{") {
+		return nil, fmt.Errorf("signer data_layout has no placeholders")
+	}
+	return &Signer{params: params}, nil
+}
+
+// Version 返回签名方案版本
+func (s *Signer) Version() string {
+	return s.params.Version
+}
+
+// Params 返回签名方案参数
+func (s *Signer) Params() SignerParams {
+	return s.params
+}
 
-	period := timestamp / (5 * 60 * 1000)
+func (s *Signer) Sign(userID, requestID, userContent string, timestamp int64) string {
+	ts := strconv.FormatInt(timestamp, 10)
+	requestInfo := strings.NewReplacer(
+		"{request_id}", requestID,
+		"{timestamp}", ts,
+		"{user_id}", userID,
+	).Replace(s.params.Layout)
+	signData := strings.NewReplacer(
+		"{request_info}", requestInfo,
+		"{content_base64}", base64.StdEncoding.EncodeToString([]byte(userContent)),
+		"{request_id}", requestID,
+		"{timestamp}", ts,
+		"{user_id}", userID,
+	).Replace(s.params.DataLayout)
+
+	period := timestamp / s.params.PeriodMs
 	// Encrypt twice and return hex string
-	firstHmac := hmacSha256Hex([]byte("key-@@@@)))()((9))-xxxx&&&%%%%%"), fmt.Sprintf("%d", period))
-	signature := hmacSha256Hex([]byte(firstHmac), signData)
+	firstHmac := hmacSha256Hex([]byte(s.params.Key), strconv.FormatInt(period, 10))
+	return hmacSha256Hex([]byte(firstHmac), signData)
+}
 
-	// LogDebug("[Signature] requestInfo=%s", requestInfo)
-	// LogDebug("[Signature] userContent=%s", userContent)
-	// LogDebug("[Signature] timestamp=%d", timestamp)
-	// LogDebug("[Signature] signature=%s", signature)
+// Check 逐个校验已知样例，返回不匹配的说明
+func (s *Signer) Check(vectors []SignerVector) []string {
+	var failures []string
+	for i, v := range vectors {
+		if got := s.Sign(v.UserID, v.RequestID, v.Content, v.Timestamp); got != v.Expected {
+			failures = append(failures, fmt.Sprintf("vector %d (request_id=%s): got %s, want %s", i+1, v.RequestID, got, v.Expected))
+		}
+	}
+	return failures
+}
 
-	return signature
+// KnownVectors 返回参数自带的样例；与默认方案相同的参数未自带样例时使用默认方案的样例
+func (p SignerParams) KnownVectors() []SignerVector {
+	if len(p.Vectors) > 0 {
+		return p.Vectors
+	}
+	d := DefaultSignerParams
+	if p.Key == d.Key && p.Layout == d.Layout && p.DataLayout == d.DataLayout && p.PeriodMs == d.PeriodMs {
+		return d.Vectors
+	}
+	return nil
+}
+
+var currentSigner atomic.Pointer[Signer]
+
+func init() {
+	signer, _ := NewSigner(DefaultSignerParams)
+	currentSigner.Store(signer)
+}
+
+// CurrentSigner 返回正在使用的签名器
+func CurrentSigner() *Signer {
+	return currentSigner.Load()
+}
+
+// SetSigner 校验参数与其自带的样例后替换正在使用的签名器
+// 与默认方案不同的参数必须自带至少一个样例，避免写错的 key 或模板未经校验就生效
+func SetSigner(params SignerParams) (*Signer, error) {
+	signer, err := NewSigner(params)
+	if err != nil {
+		return nil, err
+	}
+	vectors := params.KnownVectors()
+	if len(vectors) == 0 {
+		return nil, fmt.Errorf("signer %s has no vectors; a custom scheme needs at least one vector to self-test", params.Version)
+	}
+	if failures := signer.Check(vectors); len(failures) > 0 {
+		return nil, fmt.Errorf("signer %s failed self-test: %s", params.Version, strings.Join(failures, "; "))
+	}
+	currentSigner.Store(signer)
+	LogInfo("[Signer] Using signature scheme %s", params.Version)
+	return signer, nil
+}
+
+// LoadSignerParams 按 SIGNER_CONFIG（JSON）或 SIGNER_CONFIG_FILE 读取签名参数，都未配置时返回默认方案
+// 未填写的字段沿用默认方案
+func LoadSignerParams() (SignerParams, error) {
+	data := []byte(Cfg.SignerConfig)
+	if Cfg.SignerConfig == "" && Cfg.SignerConfigFile != "" {
+		var err error
+		if data, err = os.ReadFile(Cfg.SignerConfigFile); err != nil {
+			return SignerParams{}, err
+		}
+	}
+	if len(data) == 0 {
+		return DefaultSignerParams, nil
+	}
+	return ParseSignerParams(data)
+}
+
+// ParseSignerParams 解析 JSON 格式的签名参数，未填写的字段沿用默认方案
+func ParseSignerParams(data []byte) (SignerParams, error) {
+	params := DefaultSignerParams
+	params.Vectors = nil
+	if err := json.Unmarshal(data, &params); err != nil {
+		return SignerParams{}, err
+	}
+	return params, nil
+}
+
+// InitSigner 根据配置设置签名器，配置无效时保留默认方案
+func InitSigner() {
+	if Cfg.SignerConfig == "" && Cfg.SignerConfigFile == "" {
+		return
+	}
+	params, err := LoadSignerParams()
+	if err == nil {
+		_, err = SetSigner(params)
+	}
+	if err != nil {
+		LogError("Invalid signer config, keeping %s: %v", CurrentSigner().Version(), err)
+	}
+}
+
+// StartSignerWatcher 定期检查 SIGNER_CONFIG_FILE，文件变化时热替换签名器
+func StartSignerWatcher() {
+	if Cfg.SignerConfigFile == "" || Cfg.SignerConfig != "" {
+		return
+	}
+	var lastMod time.Time
+	if info, err := os.Stat(Cfg.SignerConfigFile); err == nil {
+		lastMod = info.ModTime()
+	}
+	ticker := time.NewTicker(30 * time.Second)
+	go func() {
+		for range ticker.C {
+			info, err := os.Stat(Cfg.SignerConfigFile)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			LogInfo("[Signer] %s changed, reloading", Cfg.SignerConfigFile)
+			InitSigner()
+		}
+	}()
+}
+
+func GenerateSignature(userID, requestID, userContent string, timestamp int64) string {
+	return CurrentSigner().Sign(userID, requestID, userContent, timestamp)
 }
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignerDefaultVectors(t *testing.T) {
+	signer, err := NewSigner(DefaultSignerParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures := signer.Check(DefaultSignerParams.KnownVectors()); len(failures) > 0 {
+		t.Errorf("default vectors: %v", failures)
+	}
+
+	// 同一周期内签名只随内容变化，跨周期变化
+	v := DefaultSignerParams.Vectors[0]
+	sig := signer.Sign(v.UserID, v.RequestID, v.Content, v.Timestamp)
+	if signer.Sign(v.UserID, v.RequestID, v.Content+"!", v.Timestamp) == sig {
+		t.Error("signature ignores content")
+	}
+	if signer.Sign(v.UserID, v.RequestID, v.Content, v.Timestamp+DefaultSignerParams.PeriodMs) == sig {
+		t.Error("signature ignores period")
+	}
+}
+
+func TestSignerParams(t *testing.T) {
+	for name, params := range map[string]SignerParams{
+		"no version":     {Key: "k", DataLayout: "{timestamp}", PeriodMs: 1},
+		"no key":         {Version: "v", DataLayout: "{timestamp}", PeriodMs: 1},
+		"no period":      {Version: "v", Key: "k", DataLayout: "{timestamp}"},
+		"no placeholder": {Version: "v", Key: "k", DataLayout: "static", PeriodMs: 1},
+	} {
+		if _, err := NewSigner(params); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// 只改版本号时参数与默认方案相同，沿用内置样例；改了 key 则没有样例
+	params, err := ParseSignerParams([]byte(`{"version":"v1-renamed"}`))
+	if err != nil || len(params.KnownVectors()) != len(DefaultSignerParams.Vectors) {
+		t.Errorf("renamed default: %d vectors, %v", len(params.KnownVectors()), err)
+	}
+	params, _ = ParseSignerParams([]byte(`{"version":"v2","key":"other"}`))
+	if len(params.KnownVectors()) != 0 {
+		t.Errorf("custom key inherited %d default vectors", len(params.KnownVectors()))
+	}
+}
+
+func TestSignerCheck(t *testing.T) {
+	signer, _ := NewSigner(DefaultSignerParams)
+	vectors := append([]SignerVector(nil), DefaultSignerParams.Vectors...)
+	vectors[1].Expected = strings.Repeat("0", 64)
+	failures := signer.Check(vectors)
+	if len(failures) != 1 || !strings.Contains(failures[0], "vector 2") {
+		t.Errorf("failures %v", failures)
+	}
+}
+
+func TestSetSigner(t *testing.T) {
+	defer SetSigner(DefaultSignerParams)
+
+	custom := DefaultSignerParams
+	custom.Version = "v2"
+	custom.Key = "another-key"
+	custom.Vectors = nil
+
+	// 自定义方案没有样例时不生效
+	if _, err := SetSigner(custom); err == nil || CurrentSigner().Version() != "v1" {
+		t.Errorf("custom scheme without vectors: err=%v, current %s", err, CurrentSigner().Version())
+	}
+
+	// 样例不通过时不生效
+	v := SignerVector{UserID: "user-1", RequestID: "req-1", Content: "hi", Timestamp: 1735689600000}
+	v.Expected = CurrentSigner().Sign(v.UserID, v.RequestID, v.Content, v.Timestamp)
+	custom.Vectors = []SignerVector{v}
+	if _, err := SetSigner(custom); err == nil || CurrentSigner().Version() != "v1" {
+		t.Errorf("failing vector: err=%v, current %s", err, CurrentSigner().Version())
+	}
+
+	// 样例通过后替换正在使用的签名器
+	signer, _ := NewSigner(custom)
+	custom.Vectors[0].Expected = signer.Sign(v.UserID, v.RequestID, v.Content, v.Timestamp)
+	if _, err := SetSigner(custom); err != nil || CurrentSigner().Version() != "v2" {
+		t.Fatalf("valid scheme: err=%v, current %s", err, CurrentSigner().Version())
+	}
+	if got := GenerateSignature(v.UserID, v.RequestID, v.Content, v.Timestamp); got != custom.Vectors[0].Expected {
+		t.Errorf("GenerateSignature %s", got)
+	}
+}
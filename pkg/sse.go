@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 心跳格式（SSE_KEEPALIVE_MODE）
+const (
+	KeepaliveComment = "comment" // SSE 注释行 ": keepalive"
+	KeepaliveDelta   = "delta"   // 空 delta 的 chunk，用于忽略注释行的客户端
+)
+
+// sseWriter 串行写出 SSE 分块；超过 SSE_KEEPALIVE_INTERVAL 没有输出时发送心跳，
+// 避免长时间思考或搜索时被反向代理、客户端的空闲超时断开
+type sseWriter struct {
+	mu           sync.Mutex
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	completionID string
+	modelName    string
+	lastWrite    time.Time
+	err          error            // 第一次写入失败的错误，之后不再写入
+	resume       *resumableStream // 不为 nil 时数据事件编号并缓存，客户端断开后继续缓存
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+// newSSEWriter 设置 SSE 响应头并启动心跳，结束时需调用 Close
+// 不支持 Flush 的响应（如 Vercel 回退路径）在结束时一次性发出，心跳无法送达客户端，因此不启动
+func newSSEWriter(w http.ResponseWriter, completionID, modelName string) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	s := &sseWriter{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		completionID: completionID,
+		modelName:    modelName,
+		lastWrite:    time.Now(),
+	}
+	if Cfg.SSEKeepaliveInterval > 0 && canFlush(w) {
+		s.stop = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.keepalive(Cfg.SSEKeepaliveInterval)
+	}
+	return s
+}
+
+func (s *sseWriter) chunkData(delta Delta, finishReason *string) []byte {
+	chunk := ChatCompletionChunk{
+		ID:      s.completionID,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   s.modelName,
+		Choices: []Choice{{
+			Index:        0,
+			Delta:        delta,
+			FinishReason: finishReason,
+		}},
+	}
+	data, _ := json.Marshal(chunk)
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
+
+// send 写出并立即刷新，调用方需持有锁；写入失败说明客户端已断开
+func (s *sseWriter) send(p []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.w.Write(p); err != nil {
+		s.err = err
+		return err
+	}
+	// 不支持 Flush 时（如 Vercel 回退路径）忽略，内容在响应结束时一并发出
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.err = err
+		return err
+	}
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// event 写出一个数据事件；可续传时客户端写入失败不返回错误，上游输出继续缓存
+func (s *sseWriter) event(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resume == nil {
+		return s.send(data)
+	}
+	s.send(s.resume.Append(data))
+	return nil
+}
+
+// Chunk 写出一个 chat.completion.chunk
+func (s *sseWriter) Chunk(delta Delta, finishReason *string) error {
+	return s.event(s.chunkData(delta, finishReason))
+}
+
+// Frame 原样写出一个已编码的事件（续传时补发缓存的事件）
+func (s *sseWriter) Frame(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send(p)
+}
+
+// ErrorResponse OpenAI 格式的错误，流式输出中作为一个 data 事件发送
+type ErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    string `json:"code,omitempty"`
+	} `json:"error"`
+}
+
+// newUpstreamErrorResponse 将上游错误转换为 OpenAI 格式，保留上游的 code 与 message
+func newUpstreamErrorResponse(e *UpstreamError) ErrorResponse {
+	var resp ErrorResponse
+	resp.Error.Message = e.Message
+	resp.Error.Type = e.Type
+	if resp.Error.Type == "" {
+		resp.Error.Type = "upstream_error"
+	}
+	resp.Error.Code = e.Code
+	return resp
+}
+
+// writeErrorResponse 以 OpenAI 格式返回错误响应，z.ai 与 OpenAI 兼容后端的错误对客户端一致
+func writeErrorResponse(w http.ResponseWriter, statusCode int, e *UpstreamError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(newUpstreamErrorResponse(e))
+}
+
+// Error 写出上游错误事件，之后仍需写出结束分块与 [DONE]
+func (s *sseWriter) Error(e *UpstreamError) error {
+	data, _ := json.Marshal(newUpstreamErrorResponse(e))
+	return s.event([]byte(fmt.Sprintf("data: %s\n\n", data)))
+}
+
+// Done 写出结束标记 [DONE]
+func (s *sseWriter) Done() error {
+	return s.event([]byte("data: [DONE]\n\n"))
+}
+
+func (s *sseWriter) keepalive(interval time.Duration) {
+	defer close(s.stopped)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+		s.mu.Lock()
+		if s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		wait := interval - time.Since(s.lastWrite)
+		if wait <= 0 {
+			if Cfg.SSEKeepaliveMode == KeepaliveDelta {
+				s.send(s.chunkData(Delta{}, nil))
+			} else {
+				s.send([]byte(": keepalive\n\n"))
+			}
+			wait = interval
+		}
+		s.mu.Unlock()
+		timer.Reset(wait)
+	}
+}
+
+// Close 停止心跳，之后不会再有并发写入；可续传时标记输出结束
+func (s *sseWriter) Close() {
+	if s.resume != nil {
+		s.resume.Finish()
+	}
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+	s.stop = nil
+}
+
+// canFlush 判断 ResponseWriter（含 Unwrap 包装链）是否支持逐块刷新
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(http.Flusher); ok {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// sseReaderSize 读缓冲区大小，绝大多数 SSE 行在缓冲区内直接返回，不做拷贝
+const sseReaderSize = 64 * 1024
+
+// sseLongLineKeep 超过该容量的长行缓冲区用完后不放回 bufferPool，避免池中长期占用大块内存
+const sseLongLineKeep = 1024 * 1024
+
+var sseReaderPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, sseReaderSize)
+	},
+}
+
+// bufferPool 长行拼接缓冲区，预分配 64KB
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, 64*1024))
+	},
+}
+
+// sseReader 逐行读取上游 SSE，行长度不受限制（bufio.Scanner 遇到超过缓冲区的行会直接失败）
+// 读缓冲区与长行缓冲区来自对象池，用完需调用 Release
+type sseReader struct {
+	br   *bufio.Reader
+	long *bytes.Buffer // 超过读缓冲区的行在此拼接，从 bufferPool 借用
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	br := sseReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &sseReader{br: br}
+}
+
+// ReadLine 返回下一行（不含换行符），只在下一次调用 ReadLine 前有效；读完时返回 io.EOF
+func (r *sseReader) ReadLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		if r.long == nil {
+			r.long = bufferPool.Get().(*bytes.Buffer)
+		}
+		r.long.Reset()
+		r.long.Write(line)
+		for err == bufio.ErrBufferFull {
+			line, err = r.br.ReadSlice('\n')
+			r.long.Write(line)
+		}
+		line = r.long.Bytes()
+	}
+	// 最后一行没有换行符时先返回该行，下一次调用再返回 io.EOF
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// Release 归还缓冲区，之后不能再使用 r 与它返回的行
+func (r *sseReader) Release() {
+	r.br.Reset(nil)
+	sseReaderPool.Put(r.br)
+	if r.long != nil && r.long.Cap() <= sseLongLineKeep {
+		r.long.Reset()
+		bufferPool.Put(r.long)
+	}
+	r.br, r.long = nil, nil
+}
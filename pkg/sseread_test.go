@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"zai-proxy/pkg/fakeupstream"
+)
+
+// benchmarkStream 一次典型的思考 + 回答输出，共约 2000 个增量事件
+func benchmarkStream() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fakeupstream.FormatEvent(fakeupstream.Event{Phase: "thinking", DeltaContent: "<details>\n> "}))
+	for i := 0; i < 400; i++ {
+		buf.WriteString(fakeupstream.FormatEvent(fakeupstream.Event{Phase: "thinking", DeltaContent: "考虑一下 step "}))
+	}
+	for i := 0; i < 1600; i++ {
+		buf.WriteString(fakeupstream.FormatEvent(fakeupstream.Event{Phase: "answer", DeltaContent: "token, 词元 "}))
+	}
+	buf.WriteString(fakeupstream.FormatEvent(fakeupstream.Event{Phase: "done", Done: true}))
+	return buf.Bytes()
+}
+
+// scannerTranslate 改用 sseReader 之前的读取方式，作为基准对照
+func scannerTranslate(body io.Reader, handle func(TranslatedEvent) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	t := NewTranslator()
+	for scanner.Scan() {
+		line := scanner.Text()
+		LogDebug("[Upstream] %s", line)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var data UpstreamData
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+			continue
+		}
+		if data.Data.Phase == "done" {
+			break
+		}
+		for _, ev := range t.Feed(&data) {
+			handle(ev)
+		}
+	}
+	for _, ev := range t.Finish() {
+		handle(ev)
+	}
+	return scanner.Err()
+}
+
+func BenchmarkTranslateUpstream(b *testing.B) {
+	stream := benchmarkStream()
+	discard := func(TranslatedEvent) error { return nil }
+
+	b.Run("scanner", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			scannerTranslate(bytes.NewReader(stream), discard)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			translateUpstream(context.Background(), io.NopCloser(bytes.NewReader(stream)), discard)
+		}
+	})
+}
+
+func BenchmarkSSEReader(b *testing.B) {
+	stream := benchmarkStream()
+
+	b.Run("scanner", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			scanner := bufio.NewScanner(bytes.NewReader(stream))
+			scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+			for scanner.Scan() {
+				_ = scanner.Text()
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(int64(len(stream)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := newSSEReader(bytes.NewReader(stream))
+			for {
+				if _, err := reader.ReadLine(); err != nil {
+					break
+				}
+			}
+			reader.Release()
+		}
+	})
+}
+
+func TestSSEReaderLongLine(t *testing.T) {
+	// 超过 bufio.Scanner 1MB 上限的搜索结果
+	results := strings.Repeat(`{"title":"Go","url":"https://go.dev","text":"The Go programming language"},`, 40000)
+	long := fakeupstream.FormatEvent(fakeupstream.Event{Phase: "tool_call", EditContent: `"search_result": [` + strings.TrimSuffix(results, ",") + "]"})
+	if len(long) <= 1024*1024 {
+		t.Fatalf("test line too short: %d", len(long))
+	}
+	input := "data: first\r\n" + long + "data: last"
+
+	reader := newSSEReader(strings.NewReader(input))
+	defer reader.Release()
+	var lines []string
+	for {
+		line, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	want := []string{"data: first", strings.TrimSuffix(long, "\n\n"), "", "data: last"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d: got %d bytes, want %d", i, len(lines[i]), len(want[i]))
+		}
+	}
+
+	// 长行之后的内容照常翻译
+	stream := long + fakeupstream.FormatEvent(fakeupstream.Event{Phase: "answer", DeltaContent: "After the long line."}) +
+		fakeupstream.FormatEvent(fakeupstream.Event{Phase: "done", Done: true})
+	var content strings.Builder
+	translateUpstream(context.Background(), io.NopCloser(strings.NewReader(stream)), func(ev TranslatedEvent) error {
+		if ev.Kind == EventContent {
+			content.WriteString(ev.Text)
+		}
+		return nil
+	})
+	if !strings.HasSuffix(content.String(), "After the long line.") {
+		t.Errorf("content %q", content.String())
+	}
+}
@@ -0,0 +1,527 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// errClientGone 客户端已断开（请求上下文取消或写入失败）
+var errClientGone = errors.New("client disconnected")
+
+// TranslatedEventKind 翻译后的输出事件类型
+type TranslatedEventKind int
+
+const (
+	EventReasoning    TranslatedEventKind = iota // 思考内容增量
+	EventContent                                 // 回答内容增量
+	EventCitations                               // 搜索结果，Text 为写入回答的来源列表
+	EventImages                                  // 图片搜索结果，Text 为写入回答的图片 Markdown
+	EventToolActivity                            // 工具调用（mcp），不产生文本
+	EventError                                   // 上游错误事件，之后只会有 EventFinish
+	EventFinish                                  // 回答结束
+)
+
+// FinishReasonError 上游中途报错时的 finish_reason
+const FinishReasonError = "error"
+
+// ToolActivity 上游 glm_block 中的一次工具调用，Result 为结果摘要
+// 开启 TOOL_ACTIVITY 时流式输出在 delta.tool_activity 中、非流式输出在 message.tool_activity 中返回
+type ToolActivity struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"`
+	Result    string `json:"result,omitempty"`
+	Status    string `json:"status,omitempty"`
+}
+
+// toolResultSummaryMax 工具结果摘要的最大字符数
+const toolResultSummaryMax = 500
+
+// summarizeToolResult 将工具结果（字符串、{type,text} 数组或其它 JSON）整理为截断后的文本
+func summarizeToolResult(raw json.RawMessage) string {
+	var summary string
+	var text string
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return ""
+	case json.Unmarshal(raw, &text) == nil:
+		summary = text
+	case json.Unmarshal(raw, &parts) == nil:
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+		summary = strings.Join(texts, "\n")
+	default:
+		var compact bytes.Buffer
+		if json.Compact(&compact, raw) == nil {
+			summary = compact.String()
+		} else {
+			summary = string(raw)
+		}
+	}
+	if utf8.RuneCountInString(summary) > toolResultSummaryMax {
+		summary = string([]rune(summary)[:toolResultSummaryMax]) + "…"
+	}
+	return summary
+}
+
+// TranslatedEvent 由上游 SSE 翻译得到的输出事件
+type TranslatedEvent struct {
+	Kind         TranslatedEventKind
+	Text         string
+	Citations    []SearchResult
+	Images       []ImageSearchResult
+	Tool         *ToolActivity
+	Error        *UpstreamError
+	FinishReason string
+}
+
+// UpstreamError 上游 SSE 中的错误事件（type 为 error 或 data.error、error 字段）
+type UpstreamError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"` // OpenAI 兼容后端返回的错误类型，为空时使用 upstream_error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// upstreamErrorBody 上游错误的原始格式，code 可能是数字或字符串，也可能整个错误只是一个字符串
+type upstreamErrorBody struct {
+	Code    interface{} `json:"code"`
+	Message string      `json:"message"`
+	Detail  string      `json:"detail"`
+	Type    string      `json:"type"`
+}
+
+func (b *upstreamErrorBody) UnmarshalJSON(data []byte) error {
+	var message string
+	if json.Unmarshal(data, &message) == nil {
+		*b = upstreamErrorBody{Message: message}
+		return nil
+	}
+	type plain upstreamErrorBody
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// empty 错误字段存在但没有 message、detail 与 code（如 "error": "" 或 {}），不是错误
+func (b *upstreamErrorBody) empty() bool {
+	if b == nil {
+		return true
+	}
+	if b.Message != "" || b.Detail != "" {
+		return false
+	}
+	switch code := b.Code.(type) {
+	case string:
+		return code == ""
+	case float64:
+		return code == 0
+	}
+	return true
+}
+
+func (b *upstreamErrorBody) toError() *UpstreamError {
+	e := &UpstreamError{Message: b.Message, Type: b.Type}
+	if e.Message == "" {
+		e.Message = b.Detail
+	}
+	switch code := b.Code.(type) {
+	case string:
+		e.Code = code
+	case float64:
+		e.Code = fmt.Sprint(code)
+	}
+	if e.Message == "" {
+		e.Message = "upstream error"
+	}
+	return e
+}
+
+// parseUpstreamError 解析上游错误事件，不是错误事件时返回 nil
+// 只有 type 为 error 或错误字段带有 message、code 时才是错误，空的 error 字段不影响正常输出
+func parseUpstreamError(payload []byte) *UpstreamError {
+	var frame struct {
+		Type  string             `json:"type"`
+		Error *upstreamErrorBody `json:"error"`
+		Data  struct {
+			Code    interface{}        `json:"code"`
+			Message string             `json:"message"`
+			Detail  string             `json:"detail"`
+			Error   *upstreamErrorBody `json:"error"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		return nil
+	}
+	switch {
+	case !frame.Data.Error.empty():
+		return frame.Data.Error.toError()
+	case !frame.Error.empty():
+		return frame.Error.toError()
+	case frame.Type == "error":
+		body := upstreamErrorBody{Code: frame.Data.Code, Message: frame.Data.Message, Detail: frame.Data.Detail}
+		return body.toError()
+	}
+	return nil
+}
+
+// parseErrorBody 解析上游或后端非 200 响应的错误体：OpenAI 格式的 {"error":{...}}、
+// z.ai 的 {"detail":...} 或 {"code":...,"message":...}；都不是时使用非 JSON 的响应文本或 fallback
+func parseErrorBody(body []byte, fallback string) *UpstreamError {
+	var frame struct {
+		Error   *upstreamErrorBody `json:"error"`
+		Code    interface{}        `json:"code"`
+		Message string             `json:"message"`
+		Detail  string             `json:"detail"`
+	}
+	if json.Valid(body) {
+		// detail 可能不是字符串（如参数校验错误的列表），解析失败的字段留空
+		json.Unmarshal(body, &frame)
+		if !frame.Error.empty() {
+			return frame.Error.toError()
+		}
+		top := upstreamErrorBody{Code: frame.Code, Message: frame.Message, Detail: frame.Detail}
+		if !top.empty() {
+			return top.toError()
+		}
+		return &UpstreamError{Message: fallback}
+	}
+	text := strings.TrimSpace(string(body))
+	if text == "" {
+		text = fallback
+	}
+	if utf8.RuneCountInString(text) > toolResultSummaryMax {
+		text = string([]rune(text)[:toolResultSummaryMax]) + "…"
+	}
+	return &UpstreamError{Message: text}
+}
+
+// Translator 将上游 UpstreamData 翻译为输出事件，流式与非流式响应共用
+type Translator struct {
+	thinking      ThinkingFilter
+	refs          *SearchRefFilter
+	citations     []SearchResult
+	images        []ImageSearchResult
+	contentLength int // 已输出的上游回答字符数（rune），用于从累计的 edit_content 中取增量
+	hasContent    bool
+	err           *UpstreamError
+	data          UpstreamData // 每行复用，避免逐行分配
+	events        []TranslatedEvent
+}
+
+// NewTranslator 创建翻译器
+func NewTranslator() *Translator {
+	return &Translator{refs: NewSearchRefFilter()}
+}
+
+func (t *Translator) emit(ev TranslatedEvent) {
+	if ev.Text != "" {
+		t.hasContent = true
+	}
+	t.events = append(t.events, ev)
+}
+
+func (t *Translator) emitText(kind TranslatedEventKind, text string) {
+	if text != "" {
+		t.emit(TranslatedEvent{Kind: kind, Text: text})
+	}
+}
+
+var (
+	ssePrefix    = []byte("data: ")
+	sseDone      = []byte("[DONE]")
+	sseErrorHint = []byte(`"error"`)
+)
+
+// feedLine 处理一行上游 SSE，done 为 true 表示上游已结束；line 可以直接是读缓冲区中的行
+func (t *Translator) feedLine(line []byte) (events []TranslatedEvent, done bool) {
+	payload, ok := bytes.CutPrefix(line, ssePrefix)
+	if !ok {
+		return nil, false
+	}
+	if bytes.Equal(payload, sseDone) {
+		return nil, true
+	}
+	if bytes.Contains(payload, sseErrorHint) {
+		if upErr := parseUpstreamError(payload); upErr != nil {
+			LogError("[Upstream] error event: %v", upErr)
+			return t.fail(upErr), true
+		}
+	}
+	t.data = UpstreamData{}
+	if err := json.Unmarshal(payload, &t.data); err != nil {
+		return nil, false
+	}
+	if t.data.Data.Phase == "done" {
+		return nil, true
+	}
+	return t.Feed(&t.data), false
+}
+
+// fail 上游出错，之后 Finish 只输出 finish_reason 为 error 的结束事件
+func (t *Translator) fail(upErr *UpstreamError) []TranslatedEvent {
+	t.events = t.events[:0]
+	t.err = upErr
+	t.emit(TranslatedEvent{Kind: EventError, Error: upErr})
+	return t.events
+}
+
+// Feed 处理一个上游事件，返回产生的输出事件，只在下一次调用 Feed、feedLine 或 Finish 前有效
+func (t *Translator) Feed(u *UpstreamData) []TranslatedEvent {
+	t.events = t.events[:0]
+	phase := u.Data.Phase
+
+	if phase == "thinking" && u.Data.DeltaContent != "" {
+		t.feedThinking(u.Data.DeltaContent)
+		return t.events
+	}
+	if phase != "" {
+		t.thinking.lastPhase = phase
+	}
+
+	editContent := u.GetEditContent()
+	if editContent != "" {
+		if IsSearchResultContent(editContent) {
+			// 来源列表在回答开始时输出
+			if results := ParseSearchResults(editContent); len(results) > 0 {
+				t.refs.AddSearchResults(results)
+				t.citations = results
+			}
+			return t.events
+		}
+		if strings.Contains(editContent, `"search_image"`) || strings.Contains(editContent, `"mcp"`) {
+			t.emitText(EventContent, t.refs.Process(ExtractTextBeforeGlmBlock(editContent)))
+			if tool := ParseToolActivity(editContent); tool != nil {
+				t.emit(TranslatedEvent{Kind: EventToolActivity, Tool: tool})
+			}
+			if strings.Contains(editContent, `"search_image"`) {
+				if results := ParseImageSearchResults(editContent); len(results) > 0 {
+					t.images = results
+				}
+			}
+			return t.events
+		}
+		if IsSearchToolCall(editContent, phase) {
+			return t.events
+		}
+	}
+
+	t.flushPending()
+	if remaining := t.thinking.Flush(); remaining != "" {
+		t.thinking.lastOutputChunk = remaining
+		t.emitText(EventReasoning, t.refs.Process(remaining))
+	}
+
+	content, reasoning := "", ""
+	switch {
+	case phase == "answer" && u.Data.DeltaContent != "":
+		content = u.Data.DeltaContent
+		t.contentLength += utf8.RuneCountInString(content)
+	case phase == "answer" && editContent != "":
+		// 第一个回答事件的 edit_content 以完整的思考块开头
+		if idx := strings.Index(editContent, "</details>"); idx != -1 {
+			reasoning = t.thinking.ExtractIncrementalThinking(editContent)
+			content = strings.TrimPrefix(editContent[idx+len("</details>"):], "\n")
+			t.contentLength = len([]rune(content))
+		}
+	case (phase == "other" || phase == "tool_call") && editContent != "":
+		// edit_content 是到目前为止的完整回答，只输出新增部分
+		runes := []rune(editContent)
+		if len(runes) > t.contentLength {
+			content = string(runes[t.contentLength:])
+			t.contentLength = len(runes)
+		} else {
+			content = editContent
+		}
+	}
+
+	if reasoning != "" {
+		t.emitText(EventReasoning, t.refs.Process(reasoning)+t.refs.Flush())
+	}
+	if content != "" {
+		t.emitText(EventContent, t.refs.Process(content))
+	}
+	return t.events
+}
+
+func (t *Translator) feedThinking(delta string) {
+	newRound := false
+	if t.thinking.lastPhase != "" && t.thinking.lastPhase != "thinking" {
+		t.thinking.ResetForNewRound()
+		t.thinking.thinkingRoundCount++
+		newRound = true
+	}
+	t.thinking.lastPhase = "thinking"
+
+	reasoning := t.thinking.ProcessThinking(delta)
+	if reasoning == "" {
+		return
+	}
+	if newRound && t.thinking.thinkingRoundCount > 1 {
+		reasoning = "\n\n" + reasoning
+	}
+	t.thinking.lastOutputChunk = reasoning
+	t.emitText(EventReasoning, t.refs.Process(reasoning))
+}
+
+// flushPending 输出等待回答开始的来源列表与图片
+func (t *Translator) flushPending() {
+	if len(t.citations) > 0 {
+		t.emit(TranslatedEvent{Kind: EventCitations, Text: t.refs.GetSearchResultsMarkdown(), Citations: t.citations})
+		t.citations = nil
+	}
+	if len(t.images) > 0 {
+		t.emit(TranslatedEvent{Kind: EventImages, Text: FormatImageSearchResults(t.images), Images: t.images})
+		t.images = nil
+	}
+}
+
+// Finish 上游结束后输出剩余内容与结束事件，上游报错时 finish_reason 为 error
+func (t *Translator) Finish() []TranslatedEvent {
+	t.events = t.events[:0]
+	if t.err != nil {
+		t.emit(TranslatedEvent{Kind: EventFinish, FinishReason: FinishReasonError})
+		return t.events
+	}
+	t.flushPending()
+	t.emitText(EventContent, t.refs.Flush())
+	if !t.hasContent {
+		LogError("Upstream response 200 but no content received")
+	}
+	t.emit(TranslatedEvent{Kind: EventFinish, FinishReason: "stop"})
+	return t.events
+}
+
+// translateUpstream 读取上游 SSE 并逐个回调翻译后的事件，最后一个事件为 EventFinish
+// 客户端断开（ctx 取消或 handle 返回错误）时立即停止并关闭上游响应体，返回 errClientGone；
+// 上游中途断开等读取错误按上游错误事件处理，回答以 finish_reason error 结束
+func translateUpstream(ctx context.Context, body io.ReadCloser, handle func(TranslatedEvent) error) error {
+	// 关闭响应体让阻塞中的读取立即返回
+	stop := context.AfterFunc(ctx, func() { body.Close() })
+	defer stop()
+
+	reader := newSSEReader(body)
+	defer reader.Release()
+	t := NewTranslator()
+	var readErr error
+	for ctx.Err() == nil {
+		line, err := reader.ReadLine()
+		if err != nil {
+			readErr = err
+			break
+		}
+		if currentLevel <= DEBUG {
+			LogDebug("[Upstream] %s", line)
+		}
+		events, done := t.feedLine(line)
+		for _, ev := range events {
+			if err := handle(ev); err != nil {
+				body.Close()
+				return errClientGone
+			}
+		}
+		if done {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return errClientGone
+	}
+	if readErr != nil && readErr != io.EOF {
+		LogError("[Upstream] read error: %v", readErr)
+		for _, ev := range t.fail(&UpstreamError{Code: "upstream_read_error", Message: "upstream connection lost: " + readErr.Error()}) {
+			if err := handle(ev); err != nil {
+				return errClientGone
+			}
+		}
+	}
+	for _, ev := range t.Finish() {
+		if err := handle(ev); err != nil {
+			return errClientGone
+		}
+	}
+	return nil
+}
+
+// ParseToolActivity 解析 glm_block 中的 mcp 工具调用，不是工具调用时返回 nil
+func ParseToolActivity(editContent string) *ToolActivity {
+	start := strings.Index(editContent, "<glm_block")
+	if start == -1 {
+		return nil
+	}
+	open := strings.Index(editContent[start:], ">")
+	end := strings.Index(editContent, "</glm_block>")
+	if open == -1 || end < start+open {
+		return nil
+	}
+	var block struct {
+		Type string `json:"type"`
+		Data struct {
+			Metadata struct {
+				ID        string          `json:"id"`
+				Name      string          `json:"name"`
+				Arguments string          `json:"arguments"`
+				Result    json.RawMessage `json:"result"`
+				Status    string          `json:"status"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(editContent[start+open+1:end]), &block); err != nil || block.Type != "mcp" {
+		return nil
+	}
+	m := block.Data.Metadata
+	return &ToolActivity{ID: m.ID, Name: m.Name, Arguments: m.Arguments, Result: summarizeToolResult(m.Result), Status: m.Status}
+}
+
+// toolActivityKey 请求上下文中的标记：本次请求输出工具调用
+type toolActivityKey struct{}
+
+// ToolActivityHeader 按请求开启（true）或关闭（false）工具调用输出，缺省时使用 TOOL_ACTIVITY
+const ToolActivityHeader = "X-Tool-Activity"
+
+// withToolActivity 根据 TOOL_ACTIVITY 与请求头决定是否输出工具调用，开启时在请求上下文中标记
+func withToolActivity(r *http.Request) *http.Request {
+	enabled := Cfg.ToolActivity
+	if v := r.Header.Get(ToolActivityHeader); v != "" {
+		enabled = v == "true" || v == "1"
+	}
+	if !enabled {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), toolActivityKey{}, true))
+}
+
+func toolActivityEnabled(ctx context.Context) bool {
+	return ctx.Value(toolActivityKey{}) != nil
+}
+
+// mergeToolActivity 同一 id 的工具调用（如状态更新）只保留最新的一条，顺序按首次出现
+func mergeToolActivity(tools []ToolActivity, tool *ToolActivity) []ToolActivity {
+	if tool.ID != "" {
+		for i := range tools {
+			if tools[i].ID == tool.ID {
+				tools[i] = *tool
+				return tools
+			}
+		}
+	}
+	return append(tools, *tool)
+}
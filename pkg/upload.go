@@ -1,12 +1,10 @@
 package pkg
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -41,8 +39,8 @@ type UpstreamFile struct {
 	Media  string             `json:"media"`
 }
 
-// UploadImageFromURL 从 URL 或 base64 上传图片到 z.ai
-func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
+// UploadImageFromURL 从 URL 或 base64 上传图片到 z.ai，客户端断开时 ctx 取消下载与上传
+func UploadImageFromURL(ctx context.Context, token string, imageURL string) (*UpstreamFile, error) {
 	var imageData []byte
 	var filename string
 	var contentType string
@@ -86,7 +84,7 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 		filename = uuid.New().String()[:12] + ext
 	} else {
 		// 从 URL 下载图片
-		resp, err := http.Get(imageURL)
+		resp, err := upstream.Download(ctx, imageURL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to download image: %v", err)
 		}
@@ -117,53 +115,15 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 		}
 	}
 
-	// 构建 multipart form 请求
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
-
-	part, err := writer.CreateFormFile("file", filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %v", err)
-	}
-
-	if _, err := part.Write(imageData); err != nil {
-		return nil, fmt.Errorf("failed to write image data: %v", err)
-	}
-
-	writer.Close()
-
-	// 发送上传请求
-	req, err := http.NewRequest("POST", "https://chat.z.ai/api/v1/files/", &buf)
+	uploadResp, err := upstream.UploadFile(ctx, token, filename, imageData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create upload request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Origin", "https://chat.z.ai")
-	req.Header.Set("Referer", "https://chat.z.ai/")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to upload image: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("upload failed: status %d, body: %s", resp.StatusCode, string(body))
-	}
-
-	var uploadResp FileUploadResponse
-	if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
-		return nil, fmt.Errorf("failed to parse upload response: %v", err)
+		return nil, err
 	}
 
 	// 构建上游文件格式
 	return &UpstreamFile{
 		Type:   "image",
-		File:   uploadResp,
+		File:   *uploadResp,
 		ID:     uploadResp.ID,
 		URL:    fmt.Sprintf("/api/v1/files/%s/content", uploadResp.ID),
 		Name:   uploadResp.Filename,
@@ -175,18 +135,38 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 	}, nil
 }
 
-// UploadImages 批量上传图片
-func UploadImages(token string, imageURLs []string) ([]*UpstreamFile, error) {
-	var files []*UpstreamFile
-	for _, url := range imageURLs {
-		file, err := UploadImageFromURL(token, url)
-		if err != nil {
-			LogError("Failed to upload image %s: %v", url[:min(50, len(url))], err)
-			continue
-		}
-		files = append(files, file)
+// imageUploads 一次请求内已上传的图片，重试时复用文件 id 不重复上传
+// 文件属于上传它的上游用户，换 token 后按新用户重新上传；会话模式下经 ConversationStore 跨请求复用
+type imageUploads struct {
+	store *ConversationStore
+	files map[string]*UpstreamFile
+}
+
+func newImageUploads(turn *conversationTurn) *imageUploads {
+	u := &imageUploads{files: make(map[string]*UpstreamFile)}
+	if turn != nil {
+		u.store = turn.store
+	}
+	return u
+}
+
+func (u *imageUploads) upload(ctx context.Context, token, userID, imageURL string) (*UpstreamFile, error) {
+	key := uploadKey(userID, imageURL)
+	if f, ok := u.files[key]; ok {
+		return f, nil
+	}
+	var f *UpstreamFile
+	var err error
+	if u.store != nil {
+		f, err = u.store.upload(ctx, token, userID, imageURL)
+	} else {
+		f, err = UploadImageFromURL(ctx, token, imageURL)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return files, nil
+	u.files[key] = f
+	return f, nil
 }
 
 func min(a, b int) int {
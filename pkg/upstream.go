@@ -0,0 +1,362 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/corpix/uarand"
+	"github.com/google/uuid"
+)
+
+// Upstream 抽象所有发往 z.ai 的 HTTP 调用，便于切换镜像、区域节点或测试替身
+type Upstream interface {
+	// BaseURL 返回上游根地址，例如 https://chat.z.ai
+	BaseURL() string
+	// ChatCompletions 发起 v2 对话请求，返回的 SSE 响应体由调用方关闭
+	ChatCompletions(ctx context.Context, req *UpstreamChatRequest) (*http.Response, error)
+	// UploadFile 上传文件
+	UploadFile(ctx context.Context, token, filename string, data []byte) (*FileUploadResponse, error)
+	// AnonymousAuth 获取匿名 token
+	AnonymousAuth(ctx context.Context) (string, error)
+	// SignIn 使用邮箱密码登录
+	SignIn(ctx context.Context, email, password string) (string, error)
+	// FetchHomePage 获取前端首页 HTML，用于解析前端版本
+	FetchHomePage(ctx context.Context) ([]byte, error)
+	// Download 下载任意 URL（如客户端提供的图片），与上游共用同一个 HTTP 客户端
+	Download(ctx context.Context, url string) (*http.Response, error)
+	// ListModels 获取上游模型目录
+	ListModels(ctx context.Context, token string) ([]UpstreamModelInfo, error)
+}
+
+// UpstreamModelInfo 上游 /api/models 返回的一个模型
+type UpstreamModelInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Info struct {
+		IsActive *bool `json:"is_active,omitempty"`
+	} `json:"info"`
+}
+
+// UpstreamChatRequest 一次 v2 对话请求所需的参数，签名由调用方生成
+type UpstreamChatRequest struct {
+	Token     string
+	UserID    string
+	RequestID string
+	ChatID    string
+	Timestamp int64
+	Signature string
+	FeVersion string
+	Body      []byte
+}
+
+// HeaderProfile 上游请求附带的浏览器特征头
+type HeaderProfile struct {
+	UserAgent      string // 为空时每个请求使用随机 UA
+	AcceptLanguage string
+	Extra          map[string]string
+}
+
+// UpstreamOptions 构造 ZAIUpstream 的参数
+type UpstreamOptions struct {
+	BaseURL        string
+	AuthBaseURL    string // 登录接口根地址，为空时与 BaseURL 相同
+	ChatTimeout    time.Duration
+	RequestTimeout time.Duration
+	ConnectTimeout time.Duration
+	Headers        HeaderProfile
+	Client         *http.Client // 为空时按超时配置新建
+}
+
+// ZAIUpstream 基于 net/http 的 Upstream 实现，所有请求共用一个连接池
+type ZAIUpstream struct {
+	opts   UpstreamOptions
+	client *http.Client
+}
+
+// NewZAIUpstream 创建上游客户端
+func NewZAIUpstream(opts UpstreamOptions) *ZAIUpstream {
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+	if opts.AuthBaseURL == "" {
+		opts.AuthBaseURL = opts.BaseURL
+	}
+	opts.AuthBaseURL = strings.TrimRight(opts.AuthBaseURL, "/")
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy: outboundProxy,
+				DialContext: (&net.Dialer{
+					Timeout:   opts.ConnectTimeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout: opts.ConnectTimeout,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return &ZAIUpstream{opts: opts, client: client}
+}
+
+var upstream Upstream = NewZAIUpstream(UpstreamOptions{
+	BaseURL:        "https://chat.z.ai",
+	ChatTimeout:    300 * time.Second,
+	RequestTimeout: 15 * time.Second,
+	ConnectTimeout: 10 * time.Second,
+})
+
+// InitUpstream 根据配置创建默认上游客户端
+func InitUpstream() {
+	SetUpstream(NewZAIUpstream(UpstreamOptions{
+		BaseURL:        Cfg.UpstreamBaseURL,
+		AuthBaseURL:    Cfg.AuthBaseURL,
+		ChatTimeout:    Cfg.UpstreamTimeout,
+		RequestTimeout: Cfg.UpstreamRequestTimeout,
+		ConnectTimeout: Cfg.UpstreamConnectTimeout,
+		Headers: HeaderProfile{
+			UserAgent:      Cfg.UpstreamUserAgent,
+			AcceptLanguage: Cfg.UpstreamAcceptLanguage,
+			Extra:          Cfg.UpstreamExtraHeaders,
+		},
+	}))
+	if Cfg.UpstreamBaseURL != "https://chat.z.ai" {
+		LogInfo("Using upstream %s", Cfg.UpstreamBaseURL)
+	}
+}
+
+// SetUpstream 替换全局上游实现（例如指向本地测试服务器）
+func SetUpstream(u Upstream) {
+	upstream = u
+}
+
+// GetUpstream 返回当前使用的上游实现
+func GetUpstream() Upstream {
+	return upstream
+}
+
+func (u *ZAIUpstream) BaseURL() string {
+	return u.opts.BaseURL
+}
+
+func (u *ZAIUpstream) applyHeaders(req *http.Request, referer string) {
+	ua := u.opts.Headers.UserAgent
+	if ua == "" {
+		ua = uarand.GetRandom()
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Origin", u.opts.BaseURL)
+	req.Header.Set("Referer", referer)
+	if u.opts.Headers.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", u.opts.Headers.AcceptLanguage)
+	}
+	for k, v := range u.opts.Headers.Extra {
+		req.Header.Set(k, v)
+	}
+}
+
+// do 发送请求并在超时后取消，响应体关闭时释放超时上下文
+func (u *ZAIUpstream) do(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (u *ZAIUpstream) ChatCompletions(ctx context.Context, r *UpstreamChatRequest) (*http.Response, error) {
+	url := fmt.Sprintf("%s/api/v2/chat/completions?timestamp=%d&requestId=%s&user_id=%s&version=0.0.1&platform=web&token=%s&current_url=%s&pathname=%s&signature_timestamp=%d",
+		u.opts.BaseURL,
+		r.Timestamp, r.RequestID, r.UserID, r.Token,
+		fmt.Sprintf("%s/c/%s", u.opts.BaseURL, r.ChatID),
+		fmt.Sprintf("/c/%s", r.ChatID),
+		r.Timestamp)
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	u.applyHeaders(req, fmt.Sprintf("%s/c/%s", u.opts.BaseURL, uuid.New().String()))
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	req.Header.Set("X-FE-Version", r.FeVersion)
+	req.Header.Set("X-Signature", r.Signature)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "keep-alive")
+
+	return u.do(tokenProxyContext(ctx, r.UserID), req, u.opts.ChatTimeout)
+}
+
+func (u *ZAIUpstream) UploadFile(ctx context.Context, token, filename string, data []byte) (*FileUploadResponse, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %v", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write image data: %v", err)
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("POST", u.opts.BaseURL+"/api/v1/files/", &buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload request: %v", err)
+	}
+	u.applyHeaders(req, u.opts.BaseURL+"/")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := u.do(tokenProxyContext(ctx, tokenUserID(token)), req, u.opts.RequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("upload failed: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var uploadResp FileUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+		return nil, fmt.Errorf("failed to parse upload response: %v", err)
+	}
+	return &uploadResp, nil
+}
+
+func (u *ZAIUpstream) AnonymousAuth(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", u.opts.AuthBaseURL+"/api/v1/auths/", nil)
+	if err != nil {
+		return "", err
+	}
+	u.applyHeaders(req, u.opts.BaseURL+"/")
+
+	resp, err := u.do(tokenProxyContext(ctx, TokenClassAnonymous), req, u.opts.RequestTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var authResp AnonymousAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return "", err
+	}
+	return authResp.Token, nil
+}
+
+func (u *ZAIUpstream) SignIn(ctx context.Context, email, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"email":    email,
+		"password": password,
+	})
+
+	req, err := http.NewRequest("POST", u.opts.AuthBaseURL+"/api/v1/auths/signin", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	u.applyHeaders(req, u.opts.BaseURL+"/auth")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.do(tokenProxyContext(ctx, email), req, u.opts.RequestTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var signInResp SignInResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signInResp); err != nil {
+		return "", err
+	}
+	if signInResp.Token == "" {
+		return "", fmt.Errorf("empty token in sign-in response")
+	}
+	return signInResp.Token, nil
+}
+
+func (u *ZAIUpstream) FetchHomePage(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.opts.BaseURL+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	u.applyHeaders(req, u.opts.BaseURL+"/")
+
+	resp, err := u.do(ctx, req, u.opts.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (u *ZAIUpstream) Download(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return u.do(ctx, req, u.opts.RequestTimeout)
+}
+
+func (u *ZAIUpstream) ListModels(ctx context.Context, token string) ([]UpstreamModelInfo, error) {
+	req, err := http.NewRequest("GET", u.opts.BaseURL+"/api/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	u.applyHeaders(req, u.opts.BaseURL+"/")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := u.do(tokenProxyContext(ctx, tokenUserID(token)), req, u.opts.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var list struct {
+		Data []UpstreamModelInfo `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
@@ -0,0 +1,316 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// UsageRecord 单次请求的用量记录，请求结束时追加写入用量账本
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Key              string    `json:"key"`
+	Model            string    `json:"model"`
+	UpstreamModel    string    `json:"upstream_model,omitempty"`
+	TokenHash        string    `json:"token_hash,omitempty"`
+	TokenClass       string    `json:"token_class,omitempty"`
+	Stream           bool      `json:"stream"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	ReasoningTokens  int       `json:"reasoning_tokens"`
+	Images           int       `json:"images"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           string    `json:"status"`
+	StatusCode       int       `json:"status_code"`
+	PartialChars     int       `json:"partial_chars,omitempty"` // 客户端中途断开前已输出的字符数
+
+	contentCounter   tokenCounter
+	reasoningCounter tokenCounter
+	budget           *budgetReservation // Check 预留的预算，Commit 时结算
+}
+
+// NewUsageRecord 在请求开始时创建记录，并估算提示词 token 与图片数量
+func NewUsageRecord(key string, req *ChatRequest) *UsageRecord {
+	rec := &UsageRecord{
+		Time:   time.Now(),
+		Key:    key,
+		Model:  req.Model,
+		Stream: req.Stream,
+	}
+	var prompt tokenCounter
+	for _, msg := range req.Messages {
+		text, imageURLs := msg.ParseContent()
+		prompt.Add(text)
+		prompt.extra += 4 // 每条消息的角色与分隔符开销
+		rec.Images += len(imageURLs)
+	}
+	rec.PromptTokens = prompt.Tokens()
+	return rec
+}
+
+// SetToken 记录实际使用的上游 token（仅保存哈希）
+func (u *UsageRecord) SetToken(token string) {
+	if payload, err := DecodeJWTPayload(token); err == nil && payload != nil && payload.ID != "" {
+		u.TokenHash = hashIdentifier(payload.ID)
+		return
+	}
+	u.TokenHash = hashIdentifier(token)
+}
+
+// AddOutput 累计已输出给客户端的内容
+func (u *UsageRecord) AddOutput(content, reasoning string) {
+	u.contentCounter.Add(content)
+	u.reasoningCounter.Add(reasoning)
+}
+
+// Fail 标记请求以错误结束
+func (u *UsageRecord) Fail(statusCode int, status string) {
+	u.StatusCode = statusCode
+	u.Status = status
+}
+
+// UsageStatusClientAborted 客户端在输出完成前断开
+const UsageStatusClientAborted = "client_aborted"
+
+// Abort 标记客户端中途断开，并记录断开前已输出的字符数
+func (u *UsageRecord) Abort() {
+	u.Fail(499, UsageStatusClientAborted)
+	u.PartialChars = u.contentCounter.chars() + u.reasoningCounter.chars()
+}
+
+// Commit 计算耗时与 token 估算并写入账本
+func (u *UsageRecord) Commit() {
+	if u.StatusCode == 0 {
+		u.StatusCode = 200
+		u.Status = "ok"
+	}
+	u.LatencyMs = time.Since(u.Time).Milliseconds()
+	u.CompletionTokens = u.contentCounter.Tokens()
+	u.ReasoningTokens = u.reasoningCounter.Tokens()
+	requestsByStatus.Inc(u.Status)
+
+	if usageLedger != nil {
+		if err := usageLedger.Append(u); err != nil {
+			LogError("Failed to write usage record: %v", err)
+		}
+	}
+	if budgetTracker != nil {
+		budgetTracker.Record(u)
+	}
+}
+
+// tokenCounter 粗略估算 token 数：ASCII 约 4 字符 1 token，其它字符（如中文）约 1 字符 1 token
+type tokenCounter struct {
+	ascii    int
+	nonASCII int
+	extra    int
+}
+
+func (c *tokenCounter) Add(s string) {
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			c.ascii++
+			i++
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		c.nonASCII++
+		i += size
+	}
+}
+
+func (c *tokenCounter) chars() int {
+	return c.ascii + c.nonASCII
+}
+
+func (c *tokenCounter) Tokens() int {
+	return (c.ascii+3)/4 + c.nonASCII + c.extra
+}
+
+// ClientKeyID 返回客户端凭据的稳定标识，用于用量统计和按 key 配置
+// 匿名请求与账号池请求分别记为 "free"、"pool"，其余为 token 哈希，不记录原文
+func ClientKeyID(token string) string {
+	if token == "free" || token == "pool" {
+		return token
+	}
+	return "key-" + hashIdentifier(token)[:12]
+}
+
+func hashIdentifier(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// UsageLedger 基于 JSONL 文件的追加写用量账本
+type UsageLedger struct {
+	mu   sync.Mutex
+	path string
+}
+
+var usageLedger *UsageLedger
+
+// InitUsageLedger 根据配置启用用量账本，未配置路径时不记录
+func InitUsageLedger() {
+	if Cfg.UsageLedgerPath == "" {
+		return
+	}
+	if dir := filepath.Dir(Cfg.UsageLedgerPath); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			LogError("Failed to create usage ledger directory: %v", err)
+			return
+		}
+	}
+	usageLedger = &UsageLedger{path: Cfg.UsageLedgerPath}
+	LogInfo("Usage ledger enabled: %s", Cfg.UsageLedgerPath)
+}
+
+func (l *UsageLedger) Append(rec *UsageRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(line)
+	return err
+}
+
+// Scan 按写入顺序遍历账本中的所有记录，损坏的行会被跳过
+// 只在锁内记下当前文件大小，读取不阻塞 Append；扫描期间追加的记录不包含在内
+func (l *UsageLedger) Scan(fn func(rec *UsageRecord)) error {
+	l.mu.Lock()
+	f, err := os.Open(l.path)
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+		if err != nil {
+			f.Close()
+		}
+	}
+	l.mu.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	// Append 在锁内写入整行，记下的大小总在行边界上
+	reader := bufio.NewReader(io.LimitReader(f, info.Size()))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec UsageRecord
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr == nil {
+				fn(&rec)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// UsageFilter 用量报表的过滤条件，空字段表示不过滤
+type UsageFilter struct {
+	From  string // YYYY-MM-DD，含当天
+	To    string // YYYY-MM-DD，含当天
+	Key   string
+	Model string
+}
+
+// UsageSummary 按 日期/key/模型 聚合后的用量
+type UsageSummary struct {
+	Day              string `json:"day"`
+	Key              string `json:"key"`
+	Model            string `json:"model"`
+	Requests         int    `json:"requests"`
+	Errors           int    `json:"errors"`
+	Aborted          int    `json:"aborted"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	ReasoningTokens  int    `json:"reasoning_tokens"`
+	Images           int    `json:"images"`
+	TotalLatencyMs   int64  `json:"total_latency_ms"`
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Aggregate 按 日期、key、模型 聚合账本记录
+func (l *UsageLedger) Aggregate(filter UsageFilter) ([]*UsageSummary, error) {
+	type groupKey struct{ day, key, model string }
+	groups := make(map[groupKey]*UsageSummary)
+
+	err := l.Scan(func(rec *UsageRecord) {
+		day := usageDay(rec.Time)
+		if filter.From != "" && day < filter.From {
+			return
+		}
+		if filter.To != "" && day > filter.To {
+			return
+		}
+		if filter.Key != "" && rec.Key != filter.Key {
+			return
+		}
+		if filter.Model != "" && rec.Model != filter.Model {
+			return
+		}
+
+		k := groupKey{day, rec.Key, rec.Model}
+		s, ok := groups[k]
+		if !ok {
+			s = &UsageSummary{Day: day, Key: rec.Key, Model: rec.Model}
+			groups[k] = s
+		}
+		s.Requests++
+		switch rec.Status {
+		case "ok":
+		case UsageStatusClientAborted:
+			s.Aborted++
+		default:
+			s.Errors++
+		}
+		s.PromptTokens += rec.PromptTokens
+		s.CompletionTokens += rec.CompletionTokens
+		s.ReasoningTokens += rec.ReasoningTokens
+		s.Images += rec.Images
+		s.TotalLatencyMs += rec.LatencyMs
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*UsageSummary, 0, len(groups))
+	for _, s := range groups {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Day != result[j].Day {
+			return result[i].Day < result[j].Day
+		}
+		if result[i].Key != result[j].Key {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result, nil
+}
@@ -1,86 +1,281 @@
 package pkg
 
 import (
-	"io"
-	"net/http"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	feVersion   string
-	versionLock sync.RWMutex
+// 前端版本的来源
+const (
+	FeVersionSourceOverride = "override" // FE_VERSION 配置
+	FeVersionSourceUpstream = "upstream" // 从上游首页解析
+	FeVersionSourceCache    = "cache"    // FE_VERSION_CACHE 中保存的上一次成功值
+	FeVersionSourceFallback = "fallback" // 内置的兜底值
 )
 
+// Fallback if fetch failed (hardcoded recent valid version)
+const fallbackFeVersion = "20241108.1"
+
+// Pattern to match: "prod-fe-frontend-20241108.1" or similar
+var feVersionPattern = regexp.MustCompile(`prod-fe-[a-zA-Z0-9\.-]+`)
+
+// FeVersionStatus 前端版本状态，用于管理接口与健康检查
+type FeVersionStatus struct {
+	Version   string `json:"version"`
+	Source    string `json:"source"`
+	FetchedAt string `json:"fetched_at,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// feVersionState 带 TTL 的前端版本缓存：过期后先返回旧值并在后台刷新，
+// 没有可用值时在请求内等待刷新；同一时刻最多只有一个刷新请求
+type feVersionState struct {
+	mu          sync.RWMutex
+	version     string
+	source      string
+	fetchedAt   time.Time
+	lastErr     string
+	lastAttempt time.Time
+	cacheLoaded bool
+
+	flightMu sync.Mutex
+	flight   *feVersionFlight
+}
+
+type feVersionFlight struct {
+	done chan struct{}
+	err  error
+}
+
+var feVersion = &feVersionState{}
+
+// cachedFeVersion 持久化到磁盘的内容
+type cachedFeVersion struct {
+	Version   string    `json:"version"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
 func GetFeVersion() string {
-	versionLock.RLock()
-	v := feVersion
-	versionLock.RUnlock()
+	if Cfg != nil && Cfg.FeVersion != "" {
+		return Cfg.FeVersion
+	}
+
+	feVersion.loadCache()
+	feVersion.mu.RLock()
+	v, fetchedAt := feVersion.version, feVersion.fetchedAt
+	feVersion.mu.RUnlock()
 
 	if v != "" {
+		if time.Since(fetchedAt) > feVersionTTL() {
+			go feVersion.refresh()
+		}
 		return v
 	}
 
-	// Try fetching once if empty
-	fetchFeVersion()
-	
-	versionLock.RLock()
-	v = feVersion
-	versionLock.RUnlock()
-	
+	// 没有可用值时等待刷新；刚刚失败过则直接使用兜底值，避免每个请求都等待首页超时
+	feVersion.mu.RLock()
+	recentlyFailed := feVersion.lastErr != "" && time.Since(feVersion.lastAttempt) < time.Minute
+	feVersion.mu.RUnlock()
+	if recentlyFailed {
+		return fallbackFeVersion
+	}
+	feVersion.refresh()
+	feVersion.mu.RLock()
+	v = feVersion.version
+	feVersion.mu.RUnlock()
 	if v != "" {
 		return v
 	}
-	
-	// Fallback if fetch failed (hardcoded recent valid version)
-	return "20241108.1" 
+	return fallbackFeVersion
 }
 
-func fetchFeVersion() {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get("https://chat.z.ai/")
-	if err != nil {
-		LogError("Failed to fetch fe version: %v", err)
+func feVersionTTL() time.Duration {
+	if Cfg == nil || Cfg.FeVersionTTL <= 0 {
+		return time.Hour
+	}
+	return Cfg.FeVersionTTL
+}
+
+// refresh 从上游首页获取版本，并发调用共享同一次请求
+func (s *feVersionState) refresh() error {
+	s.flightMu.Lock()
+	if f := s.flight; f != nil {
+		s.flightMu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &feVersionFlight{done: make(chan struct{})}
+	s.flight = f
+	s.flightMu.Unlock()
+
+	f.err = s.fetch()
+
+	s.flightMu.Lock()
+	s.flight = nil
+	s.flightMu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (s *feVersionState) fetch() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	s.mu.Unlock()
+
+	body, err := upstream.FetchHomePage(ctx)
+	if err == nil {
+		if match := feVersionPattern.FindString(string(body)); match != "" {
+			s.set(match, FeVersionSourceUpstream, time.Now())
+			return nil
+		}
+		err = fmt.Errorf("no frontend version found in home page")
+	}
+
+	LogError("Failed to fetch fe version: %v", err)
+	s.mu.Lock()
+	s.lastErr = err.Error()
+	// 保留旧值，但推迟下一次刷新，避免上游故障时每个请求都去拉取首页
+	if s.version != "" {
+		s.fetchedAt = time.Now().Add(-feVersionTTL() + time.Minute)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *feVersionState) set(version, source string, fetchedAt time.Time) {
+	s.mu.Lock()
+	changed := version != s.version
+	s.version = version
+	s.source = source
+	s.fetchedAt = fetchedAt
+	s.lastErr = ""
+	s.mu.Unlock()
+
+	if source != FeVersionSourceUpstream {
+		return
+	}
+	if changed {
+		LogInfo("Updated fe version: %s", version)
+	}
+	s.saveCache(version, fetchedAt)
+}
+
+// loadCache 首次使用时读取 FE_VERSION_CACHE，让冷启动（如 Vercel）不必先请求首页
+func (s *feVersionState) loadCache() {
+	s.mu.RLock()
+	loaded := s.cacheLoaded
+	s.mu.RUnlock()
+	if loaded {
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cacheLoaded {
+		return
+	}
+	s.cacheLoaded = true
+	if Cfg == nil || Cfg.FeVersionCache == "" || s.version != "" {
+		return
+	}
+	data, err := os.ReadFile(Cfg.FeVersionCache)
 	if err != nil {
-		LogError("Failed to read fe version response: %v", err)
 		return
 	}
+	var cached cachedFeVersion
+	if err := json.Unmarshal(data, &cached); err != nil || cached.Version == "" {
+		LogWarn("Ignoring invalid fe version cache %s", Cfg.FeVersionCache)
+		return
+	}
+	s.version = cached.Version
+	s.source = FeVersionSourceCache
+	s.fetchedAt = cached.FetchedAt
+	LogInfo("Loaded fe version %s from %s", cached.Version, Cfg.FeVersionCache)
+}
 
-	// Pattern to match: "prod-fe-frontend-20241108.1" or similar
-	// Simplified regex to catch date-like versions
-	re := regexp.MustCompile(`prod-fe-[a-zA-Z0-9\.-]+`)
-	match := re.FindString(string(body))
-	if match != "" {
-		// Clean up prefix if needed, usually we just send the whole thing
-		// Example: "prod-fe-frontend-20241108.1"
-		
-		// If strict version required (e.g. 20241108.1), refine regex
-		// But usually X-FE-Version expects the full string found in main.js URL or similar
-		// Let's stick to what worked before or a safe default.
-		// The error message said "Minimum required: 1.0.0". 
-		// Actually, let's use a very recent one found in logs or hardcode a safe one.
-		// A common format is YYYYMMDD.X
-		
-		versionLock.Lock()
-		feVersion = match
-		versionLock.Unlock()
-		LogInfo("Updated fe version: %s", match)
+func (s *feVersionState) saveCache(version string, fetchedAt time.Time) {
+	if Cfg == nil || Cfg.FeVersionCache == "" {
+		return
+	}
+	data, _ := json.Marshal(cachedFeVersion{Version: version, FetchedAt: fetchedAt})
+	tmp := Cfg.FeVersionCache + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		LogWarn("Failed to write fe version cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, Cfg.FeVersionCache); err != nil {
+		LogWarn("Failed to write fe version cache: %v", err)
 	}
 }
 
+// RefreshFeVersion 立即刷新前端版本，返回刷新后的版本
+func RefreshFeVersion() (string, error) {
+	if Cfg != nil && Cfg.FeVersion != "" {
+		return Cfg.FeVersion, nil
+	}
+	err := feVersion.refresh()
+	return GetFeVersion(), err
+}
+
+// GetFeVersionStatus 返回当前版本及来源
+func GetFeVersionStatus() FeVersionStatus {
+	if Cfg != nil && Cfg.FeVersion != "" {
+		return FeVersionStatus{Version: Cfg.FeVersion, Source: FeVersionSourceOverride}
+	}
+	feVersion.mu.RLock()
+	defer feVersion.mu.RUnlock()
+	status := FeVersionStatus{
+		Version:   feVersion.version,
+		Source:    feVersion.source,
+		LastError: feVersion.lastErr,
+	}
+	if status.Version == "" {
+		status.Version = fallbackFeVersion
+		status.Source = FeVersionSourceFallback
+	}
+	if !feVersion.fetchedAt.IsZero() {
+		status.FetchedAt = feVersion.fetchedAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// isFeVersionError 判断上游错误是否由前端版本过旧引起
+func isFeVersionError(statusCode int, body string) bool {
+	if statusCode < 400 || statusCode >= 500 || statusCode == 401 || statusCode == 429 {
+		return false
+	}
+	lower := strings.ToLower(body)
+	if !strings.Contains(lower, "version") {
+		return false
+	}
+	for _, hint := range []string{"minimum required", "outdated", "upgrade", "too old", "fe-version", "fe_version"} {
+		if strings.Contains(lower, hint) {
+			return true
+		}
+	}
+	return false
+}
+
 func StartVersionUpdater() {
-	fetchFeVersion()
+	if Cfg.FeVersion != "" {
+		LogInfo("Using fe version %s from FE_VERSION", Cfg.FeVersion)
+		return
+	}
+	feVersion.loadCache()
+	feVersion.refresh()
 
-	ticker := time.NewTicker(1 * time.Hour)
+	ticker := time.NewTicker(feVersionTTL())
 	go func() {
 		for range ticker.C {
-			fetchFeVersion()
+			feVersion.refresh()
 		}
 	}()
 }
@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocketPath WebSocket 接口，一个连接上可以并发多个对话请求
+const WebSocketPath = "/v1/ws"
+
+// wsClientMessage 客户端消息：type 为 request（默认）时 request 为对话请求体，为 cancel 时取消同 id 的请求
+type wsClientMessage struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type,omitempty"`
+	Request json.RawMessage   `json:"request,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // 覆盖本次请求的请求头，如 X-Conversation-ID
+}
+
+// wsServerMessage 服务端消息，id 为对应请求的客户端 id
+//
+//	chunk      data 为 chat.completion.chunk，与 SSE 中的分块相同
+//	done       流式输出结束（对应 data: [DONE]）
+//	response   data 为非流式请求的 chat.completion
+//	error      status 为 HTTP 状态码，data 为 OpenAI 格式错误或 error 为错误文本；流式输出中的上游错误 status 为 0
+//	cancelled  请求已按 cancel 消息取消
+type wsServerMessage struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Status int             `json:"status,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// wsRequestKey 标记经由 WebSocket 发起的请求：取消由 cancel 消息控制，不启用续传
+type wsRequestKey struct{}
+
+// wsSession 一个 WebSocket 连接及其进行中的请求
+type wsSession struct {
+	conn     *wsConn
+	header   http.Header // 握手请求头，作为每个请求的默认请求头
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// HandleWebSocket 升级为 WebSocket，按消息接收对话请求，复用 HandleChatCompletions 的全部处理逻辑
+// 浏览器无法设置 Authorization 时可以用 token 参数
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Clone()
+	if header.Get("Authorization") == "" {
+		if token := r.URL.Query().Get("token"); token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if header.Get("Authorization") == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		LogDebug("[WebSocket] upgrade failed: %v", err)
+		return
+	}
+	// 握手相关的请求头不传给对话请求
+	for _, name := range []string{"Connection", "Upgrade", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol"} {
+		header.Del(name)
+	}
+
+	s := &wsSession{conn: conn, header: header, inflight: make(map[string]context.CancelFunc)}
+	ctx, cancel := context.WithCancel(context.Background())
+	LogInfo("[WebSocket] %s connected", r.RemoteAddr)
+	closeCode := 0
+	for {
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			if e, ok := err.(*wsProtocolError); ok {
+				LogWarn("[WebSocket] %s protocol error: %v", r.RemoteAddr, err)
+				closeCode = e.code
+			} else if err != errWSClosed {
+				LogDebug("[WebSocket] %s read failed: %v", r.RemoteAddr, err)
+			}
+			break
+		}
+		if opcode != wsOpText && opcode != wsOpBinary {
+			continue
+		}
+		var msg wsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.ID == "" {
+			s.send(wsServerMessage{ID: msg.ID, Type: "error", Status: http.StatusBadRequest, Error: "Invalid message"})
+			continue
+		}
+		switch msg.Type {
+		case "", "request":
+			s.start(ctx, msg)
+		case "cancel":
+			s.cancel(msg.ID)
+		default:
+			s.send(wsServerMessage{ID: msg.ID, Type: "error", Status: http.StatusBadRequest, Error: "Unknown message type " + msg.Type})
+		}
+	}
+	// 连接断开时取消所有进行中的请求
+	cancel()
+	s.wg.Wait()
+	conn.Close(closeCode)
+	LogInfo("[WebSocket] %s disconnected", r.RemoteAddr)
+}
+
+func (s *wsSession) send(msg wsServerMessage) error {
+	data, _ := json.Marshal(msg)
+	return s.conn.WriteMessage(wsOpText, data)
+}
+
+// start 在独立的 goroutine 中处理一个请求，同一 id 同时只能有一个进行中的请求
+func (s *wsSession) start(parent context.Context, msg wsClientMessage) {
+	s.mu.Lock()
+	if _, busy := s.inflight[msg.ID]; busy {
+		s.mu.Unlock()
+		s.send(wsServerMessage{ID: msg.ID, Type: "error", Status: http.StatusConflict, Error: "Request id already in flight"})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(parent, wsRequestKey{}, true))
+	s.inflight[msg.ID] = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.inflight, msg.ID)
+			s.mu.Unlock()
+			cancel()
+		}()
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(msg.Request))
+		if err != nil {
+			s.send(wsServerMessage{ID: msg.ID, Type: "error", Status: http.StatusBadRequest, Error: "Invalid request"})
+			return
+		}
+		r.Header = s.header.Clone()
+		for name, value := range msg.Headers {
+			r.Header.Set(name, value)
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		rw := &wsResponseWriter{session: s, id: msg.ID, header: make(http.Header)}
+		HandleChatCompletions(rw, r)
+		if ctx.Err() != nil && parent.Err() == nil {
+			s.send(wsServerMessage{ID: msg.ID, Type: "cancelled"})
+			return
+		}
+		rw.finish()
+	}()
+}
+
+func (s *wsSession) cancel(id string) {
+	s.mu.Lock()
+	cancel := s.inflight[id]
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// wsResponseWriter 将 HandleChatCompletions 的输出转换为 WebSocket 消息：
+// SSE 事件逐个转发，非流式响应与错误在处理结束后作为一条消息发送
+type wsResponseWriter struct {
+	session *wsSession
+	id      string
+	header  http.Header
+	status  int
+	pending bytes.Buffer // 未完整的 SSE 事件，或非流式响应体
+}
+
+func (w *wsResponseWriter) Header() http.Header { return w.header }
+
+func (w *wsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Flush 使 HandleChatCompletions 走真实流式输出，事件在 Write 时已转发
+func (w *wsResponseWriter) Flush() {}
+
+func (w *wsResponseWriter) streaming() bool {
+	return w.status == http.StatusOK && strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (w *wsResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.pending.Write(p)
+	if !w.streaming() {
+		return len(p), nil
+	}
+	for {
+		event, _, ok := bytes.Cut(w.pending.Bytes(), []byte("\n\n"))
+		if !ok {
+			break
+		}
+		err := w.forward(event)
+		w.pending.Next(len(event) + 2)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// forward 转发一个 SSE 事件，忽略心跳注释与事件 id
+func (w *wsResponseWriter) forward(event []byte) error {
+	for _, line := range strings.Split(string(event), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		msg := wsServerMessage{ID: w.id, Type: "chunk", Data: json.RawMessage(payload)}
+		if payload == "[DONE]" {
+			msg = wsServerMessage{ID: w.id, Type: "done"}
+		} else if strings.HasPrefix(payload, `{"error"`) {
+			msg.Type = "error"
+		}
+		if err := w.session.send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish 处理结束后发送非流式响应或错误
+func (w *wsResponseWriter) finish() {
+	if w.streaming() {
+		return
+	}
+	body := bytes.TrimSpace(w.pending.Bytes())
+	msg := wsServerMessage{ID: w.id, Type: "response", Data: json.RawMessage(body)}
+	if w.status != http.StatusOK {
+		msg = wsServerMessage{ID: w.id, Type: "error", Status: w.status}
+		if json.Valid(body) {
+			msg.Data = json.RawMessage(body)
+		} else {
+			msg.Error = string(body)
+		}
+	}
+	w.session.send(msg)
+}
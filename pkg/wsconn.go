@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket 操作码（RFC 6455）
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// wsMaxMessageSize 单条消息的最大长度，请求中可能带 base64 图片
+const wsMaxMessageSize = 32 << 20
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 关闭状态码（RFC 6455 7.4.1）
+const (
+	wsCloseProtocolError = 1002
+	wsCloseMessageTooBig = 1009
+)
+
+// errWSClosed 对端发送了关闭帧
+var errWSClosed = errors.New("websocket closed")
+
+// wsProtocolError 对端违反协议，连接以 code 关闭
+type wsProtocolError struct {
+	code int
+	msg  string
+}
+
+func (e *wsProtocolError) Error() string { return e.msg }
+
+func wsProtocolErr(format string, args ...interface{}) error {
+	return &wsProtocolError{code: wsCloseProtocolError, msg: fmt.Sprintf(format, args...)}
+}
+
+// wsConn 服务端 WebSocket 连接，只实现本项目需要的部分：文本/二进制消息、分片、ping/pong 与关闭
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // 串行写帧，多个请求并发输出
+}
+
+// upgradeWebSocket 完成握手并接管连接，失败时已向客户端返回错误
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// headerHasToken 判断逗号分隔的请求头中是否包含 token（不区分大小写）
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readFrame 读取一帧并去掉掩码，客户端发来的帧必须带掩码
+// 未协商扩展，RSV 位必须为 0；控制帧不能分片且不超过 125 字节
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, wsProtocolErr("reserved bits set")
+	}
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+	case wsOpClose, wsOpPing, wsOpPong:
+		if !fin {
+			return false, 0, nil, wsProtocolErr("fragmented control frame")
+		}
+		if head[1]&0x7F > 125 {
+			return false, 0, nil, wsProtocolErr("control frame too long")
+		}
+	default:
+		return false, 0, nil, wsProtocolErr("unknown opcode %#x", opcode)
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, wsProtocolErr("unmasked client frame")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, &wsProtocolError{code: wsCloseMessageTooBig, msg: fmt.Sprintf("frame of %d bytes exceeds limit", length)}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage 读取一条完整消息，期间自动回复 ping；收到关闭帧时回复关闭并返回 errWSClosed
+// 对端违反协议或消息超过 wsMaxMessageSize 时返回 *wsProtocolError，调用方以其 code 关闭连接
+func (c *wsConn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			c.WriteMessage(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.WriteMessage(wsOpClose, payload)
+			return 0, nil, errWSClosed
+		case wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, wsProtocolErr("unexpected continuation frame")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, wsProtocolErr("expected continuation frame")
+			}
+			opcode = op
+		}
+		if len(data)+len(payload) > wsMaxMessageSize {
+			return 0, nil, &wsProtocolError{code: wsCloseMessageTooBig, msg: "message exceeds limit"}
+		}
+		data = append(data, payload...)
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+// WriteMessage 写出一条不分片、不带掩码的消息
+func (c *wsConn) WriteMessage(opcode byte, data []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := (&net.Buffers{header, data}).WriteTo(c.conn)
+	return err
+}
+
+// Close 发送关闭帧（code 为 0 时不带状态码）并关闭连接
+func (c *wsConn) Close(code int) error {
+	var payload []byte
+	if code != 0 {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+	}
+	c.WriteMessage(wsOpClose, payload)
+	return c.conn.Close()
+}